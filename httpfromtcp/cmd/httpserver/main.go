@@ -1,145 +1,175 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
-	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/livingpool/httpfromtcp/internal/client"
 	"github.com/livingpool/httpfromtcp/internal/request"
 	"github.com/livingpool/httpfromtcp/internal/response"
 	"github.com/livingpool/httpfromtcp/internal/server"
 )
 
-const port = 42069
+const (
+	port         = 42069
+	maxBodyBytes = 10 << 20
+	// shutdownTimeout is how long responses in progress get to finish on shutdown
+	shutdownTimeout = 10 * time.Second
+)
 
 // Notice the sigChan code.
 // This is a common pattern in Go for gracefully shutting down a server.
 // Because server.Server returns immediately (it handles requests in the background in goroutines)
 // if we exit main immediately, the server will just stop. We want to wait for a signal (like CTRL+C) before we stop the server.
 func main() {
-	server, err := server.Serve(port, handler)
+	server, err := server.Serve(port, newHandler(), server.WithMaxBodyBytes(maxBodyBytes))
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
+	// stop taking requests and let the ones in progress finish, for a while
+	log.Println("Server shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	upstream.CloseIdleConnections()
+
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		proxyHandler(w, req)
-		return
+// newHandler wraps the routes in what every response gets: an access log
+// line, a 500 instead of a crash, a request ID and its timing.
+func newHandler() server.Handler {
+	return server.Chain(
+		server.Logger(os.Stdout, server.CombinedLog),
+		server.Recover(),
+		server.RequestID(),
+		server.Timing(),
+	)(newRouter().Serve)
+}
+
+// newRouter maps the paths the server answers to their handlers.
+// Anything else gets a 404, and the wrong method a 405.
+func newRouter() *server.Router {
+	r := server.NewRouter()
+	r.Get("/", pageHandler)
+	r.Get("/yourproblem", func(w *response.Writer, req *request.Request) {
+		errorPage(w, req, response.StatusBadRequest, badReqHTML, "Your request honestly kinda sucked.")
+	})
+	r.Get("/myproblem", func(w *response.Writer, req *request.Request) {
+		errorPage(w, req, response.StatusInternalServerError, internalErrorHTML, "Okay, you know what? This one is on me.")
+	})
+	// navigate to http://localhost:42069/video in your browser... does it work?
+	// Seeking works too, the browser asks for the part it wants with a Range header.
+	r.Get("/video", func(w *response.Writer, req *request.Request) {
+		server.ServeFile(w, req, "./assets/vim.mp4")
+	})
+	r.Get("/assets/{path...}", assetsHandler)
+
+	httpbin := r.Group("/httpbin")
+	httpbin.Get("", proxyHandler)
+	httpbin.Get("/{path...}", proxyHandler)
+	return r
+}
+
+// assetsHandler serves the files in ./assets, with a listing at /assets/.
+var assetsHandler = server.StripPrefix("/assets", server.FileServer("./assets", server.WithDirectoryListing()))
+
+// successETag changes only when the page does, so browsers can keep their copy.
+var successETag = response.StrongETag([]byte(successHTML))
+
+// Ask twice and the second answer is a 304 with no body:
+// curl -i -H 'If-None-Match: "<etag from the first response>"' localhost:42069/
+func pageHandler(w *response.Writer, req *request.Request) {
+	h := response.GetEmptyHeaders()
+	h.Set("ETag", successETag)
+	if err := response.ServeContent(w, req, "index.html", time.Time{}, strings.NewReader(successHTML), h); err != nil {
+		log.Printf("error serving page: %v", err)
+		w.Abort()
 	}
+}
 
-	switch req.RequestLine.RequestTarget {
-	case "/yourproblem":
-		w.WriteStatusLine(response.StatusBadRequest)
-		h := response.GetDefaultHeaders(len(badReqHTML))
-		h.Override("Content-Type", "text/html")
-		w.WriteHeaders(h)
-		w.WriteBody([]byte(badReqHTML))
-	case "/myproblem":
-		w.WriteStatusLine(response.StatusInternalError)
-		h := response.GetDefaultHeaders(len(internalErrorHTML))
-		h.Override("Content-Type", "text/html")
-		w.WriteHeaders(h)
-		w.WriteBody([]byte(internalErrorHTML))
-	case "/video":
-		videoHandler(w, req)
-	default:
-		w.WriteStatusLine(response.StatusOK)
-		h := response.GetDefaultHeaders(len(successHTML))
-		h.Override("Content-Type", "text/html")
-		w.WriteHeaders(h)
-		w.WriteBody([]byte(successHTML))
+// errorPage sends page to browsers, and msg wrapped in JSON to API clients asking for it.
+// Try it with: curl -H "Accept: application/json" localhost:42069/yourproblem
+func errorPage(w *response.Writer, req *request.Request, statusCode response.StatusCode, page, msg string) {
+	contentType := req.Headers.NegotiateContentType("text/html", "application/json")
+	body := []byte(page)
+	if contentType == "application/json" {
+		body = server.ErrorJSON(statusCode, msg)
+	} else {
+		contentType = "text/html"
 	}
+
+	w.WriteStatusLine(statusCode)
+	h := response.GetEmptyHeaders()
+	h.Set("Content-Type", contentType)
+	h.Set("Vary", "Accept")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
 }
 
+// upstream keeps its connections to httpbin.org open between requests.
+var upstream = client.New(client.WithTimeout(time.Minute))
+
 // I recommend using netcat to test your chunked responses.
 // Curl will abstract away the chunking for you, so you won't see your hex and cr and lf characters in your terminal if you use curl.
 // I used this command to see my raw chunked response:
 // echo -e "GET /httpbin/stream/100 HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n" | nc localhost 42069
 // use curl --raw -v to view the whole thing
 func proxyHandler(w *response.Writer, req *request.Request) {
-	target := req.RequestLine.RequestTarget
+	target := strings.TrimPrefix(req.URL.RequestURI(), "/httpbin")
 
-	url := "https://httpbin.org/" + strings.TrimPrefix(target, "/httpbin")
-	resp, err := http.Get(url)
+	url := "https://httpbin.org" + target
+	resp, err := upstream.Get(url)
 	if err != nil {
-		log.Fatalf("error connecting to httpbin.org: %v", err)
+		log.Printf("error connecting to httpbin.org: %v", err)
+		errorPage(w, req, response.StatusBadGateway, badGatewayHTML, "Could not reach httpbin.org.")
+		return
 	}
+	defer resp.Body.Close()
 
 	// the headers are only written at the start
 	w.WriteStatusLine(response.StatusOK)
-	h := response.GetDefaultHeaders(0)
+	h := response.GetEmptyHeaders()
+	h.Set("Content-Type", "text/plain")
 	h.Set("Transfer-Encoding", "chunked")
 	h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
-	h.Delete("Content-Length")
 	w.WriteHeaders(h)
 
-	buf := make([]byte, 1024)
-	fullRespBody := make([]byte, 1024)
-	fullRespBodyLen := 0
-
-	for {
-		n, err := resp.Body.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if _, err := w.WriteChunkedBodyDone(); err != nil {
-					log.Fatalf("error writing chunked body done: %v", err)
-				}
-				hash := sha256.Sum256(fullRespBody[:fullRespBodyLen])
-				headers := response.GetEmptyHeaders()
-				headers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash))
-				headers.Set("X-Content-Length", strconv.Itoa(fullRespBodyLen))
-				w.WriteTrailers(headers)
-				return
-			}
-			log.Fatalf("error reading from httpbin.org: %v", err)
-		}
-
-		if fullRespBodyLen+n >= cap(fullRespBody) {
-			tempBuf := make([]byte, len(fullRespBody)*2)
-			copy(tempBuf, fullRespBody)
-			fullRespBody = tempBuf
-		}
-		copy(fullRespBody[fullRespBodyLen:], buf[:n])
-		fullRespBodyLen += n
-
-		fmt.Printf("read %d bytes from httpbin.org...\n", n)
-
-		if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
-			log.Fatalf("error writing chunked body: %v", err)
-		}
-	}
-}
-
-// navigate to http://localhost:42069/video in your browser... does it work?
-func videoHandler(w *response.Writer, req *request.Request) {
-	f, err := os.ReadFile("./assets/vim.mp4")
+	// hash the body on its way through
+	hash := sha256.New()
+	cw := response.NewChunkedWriterSize(w, 1024)
+	n, err := io.Copy(cw, io.TeeReader(resp.Body, hash))
 	if err != nil {
-		log.Fatalf("error reading video file: %v", err)
+		// the status line is out, all that is left is cutting the response short
+		log.Printf("error proxying httpbin.org after %d bytes: %v", n, err)
+		w.Abort()
+		return
 	}
+	log.Printf("proxied %d bytes from httpbin.org", n)
 
-	w.WriteStatusLine(response.StatusOK)
-	h := response.GetDefaultHeaders(len(f))
-	h.Override("Content-Type", "video/mp4")
-	w.WriteHeaders(h)
-	w.WriteBody(f)
+	cw.Trailers = response.GetEmptyHeaders()
+	cw.Trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash.Sum(nil)))
+	cw.Trailers.Set("X-Content-Length", strconv.FormatInt(n, 10))
+	if err := cw.Close(); err != nil {
+		log.Printf("error writing chunked body: %v", err)
+	}
 }
 
 const (
@@ -163,6 +193,16 @@ const (
   </body>
 </html>`
 
+	badGatewayHTML = `<html>
+  <head>
+    <title>502 Bad Gateway</title>
+  </head>
+  <body>
+    <h1>Bad Gateway</h1>
+    <p>httpbin.org is not talking to us right now.</p>
+  </body>
+</html>`
+
 	internalErrorHTML = `<html>
   <head>
     <title>500 Internal Server Error</title>
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 
@@ -33,12 +34,16 @@ func main() {
 		fmt.Println("- Version:", req.RequestLine.HttpVersion)
 
 		fmt.Println("Headers:")
-		for k, v := range req.Headers {
-			fmt.Printf("- %s: %s\n", k, v)
+		for _, f := range req.Headers.Fields() {
+			fmt.Printf("- %s: %s\n", f.Name, f.Value)
 		}
 
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
 		fmt.Println("Body:")
-		fmt.Println(string(req.Body))
+		fmt.Println(string(body))
 
 		fmt.Println("connection and channel closed.")
 	}
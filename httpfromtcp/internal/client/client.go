@@ -0,0 +1,418 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+)
+
+const (
+	DefaultMaxRedirects        = 10
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultIdleTimeout         = 90 * time.Second
+	DefaultMaxIdleConnsPerHost = 2
+
+	// maxDrainBytes is how much of a redirect's body is read to keep its
+	// connection. A longer one is not worth it, the connection is closed.
+	maxDrainBytes = 4 << 10
+)
+
+// ErrTooManyRedirects is returned by Do when a response is still a redirect
+// after MaxRedirects of them have been followed.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// Client sends requests over HTTP/1.1, keeping connections open between
+// them. The zero value is ready to use, and a Client is safe for concurrent use.
+type Client struct {
+	// Timeout bounds a whole exchange: connecting, sending the request,
+	// following redirects and reading the response body. Zero means no limit.
+	Timeout time.Duration
+	// DialTimeout bounds connecting, including the TLS handshake. Zero means DefaultDialTimeout.
+	DialTimeout time.Duration
+	// IdleTimeout is how long a connection is kept for the next request. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxIdleConnsPerHost caps the connections kept per host. Zero means DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+	// MaxRedirects caps the redirects followed. Zero means DefaultMaxRedirects,
+	// and a negative value returns redirects to the caller as they are.
+	MaxRedirects int
+	// TLSConfig is used for https URLs. nil means the default configuration.
+	TLSConfig *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// Option configures a Client made with New.
+type Option func(*Client)
+
+// WithTimeout bounds every exchange to d, see Client.Timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.Timeout = d
+	}
+}
+
+// WithMaxRedirects caps the redirects followed, see Client.MaxRedirects.
+func WithMaxRedirects(n int) Option {
+	return func(c *Client) {
+		c.MaxRedirects = n
+	}
+}
+
+// WithMaxIdleConnsPerHost caps the connections kept open per host.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(c *Client) {
+		c.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithTLSConfig sets the TLS configuration for https URLs.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.TLSConfig = cfg
+	}
+}
+
+func New(opts ...Option) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// conn is a connection to a server, with the parser reading its responses.
+type conn struct {
+	net.Conn
+	key       string
+	parser    *response.Parser
+	idleSince time.Time
+}
+
+// Get sends a GET request for target.
+func (c *Client) Get(target string) (*response.Response, error) {
+	req, err := request.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req and returns the response once its headers are in, following
+// redirects on the way. The body streams from the connection; the caller
+// must read it to EOF or close it, which is when the connection goes back to
+// the pool. A response with a non-2xx status is not an error.
+//
+// req needs an absolute URL, as made by request.NewRequest. A redirect that
+// would have to send the body again, such as 307 to a POST, is returned as it
+// is, since the body has been read already.
+func (c *Client) Do(req *request.Request) (*response.Response, error) {
+	if req.URL == nil || req.URL.Scheme != "http" && req.URL.Scheme != "https" || req.URL.Host == "" {
+		return nil, fmt.Errorf("%w: not an absolute http URL", request.ErrInvalidTarget)
+	}
+
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+
+	maxRedirects := c.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+	for redirects := 0; ; redirects++ {
+		resp, err := c.roundTrip(req, deadline)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", req.RequestLine.Method, req.URL, err)
+		}
+		if maxRedirects < 0 {
+			return resp, nil
+		}
+		next := redirectRequest(req, resp)
+		if next == nil {
+			return resp, nil
+		}
+		if redirects == maxRedirects {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s %s: %w: stopped after %d", req.RequestLine.Method, req.URL, ErrTooManyRedirects, redirects)
+		}
+
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// roundTrip sends req on a pooled or new connection and reads the response headers.
+func (c *Client) roundTrip(req *request.Request, deadline time.Time) (*response.Response, error) {
+	key := req.URL.Scheme + "://" + hostPort(req.URL)
+	for retried := false; ; retried = true {
+		cn, reused, err := c.getConn(key, req.URL, deadline)
+		if err != nil {
+			return nil, err
+		}
+		cn.SetDeadline(deadline)
+
+		resp, err := cn.exchange(req)
+		if err != nil {
+			cn.Close()
+			// the server may close a connection while it sits in the pool, which
+			// only shows once it is used. The request never got through, so it
+			// can go again on a new one, as long as that is safe. RFC 9112 9.3.1
+			if reused && !retried && replayable(req) && closedByServer(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		keep := resp.KeepAlive() && !hasCloseOption(req)
+		if resp.Body == request.NoBody {
+			c.release(cn, keep)
+		} else {
+			resp.Body = &body{ReadCloser: resp.Body, client: c, conn: cn, keep: keep}
+		}
+		return resp, nil
+	}
+}
+
+func (cn *conn) exchange(req *request.Request) (*response.Response, error) {
+	if err := req.Write(cn); err != nil {
+		return nil, err
+	}
+	return cn.parser.Next(req.RequestLine.Method)
+}
+
+// getConn returns an idle connection to key, or dials a new one. It reports
+// whether the connection was used before.
+func (c *Client) getConn(key string, u *url.URL, deadline time.Time) (*conn, bool, error) {
+	idleTimeout := c.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	c.mu.Lock()
+	for conns := c.idle[key]; len(conns) > 0; conns = c.idle[key] {
+		cn := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if time.Since(cn.idleSince) > idleTimeout {
+			cn.Close()
+			continue
+		}
+		c.mu.Unlock()
+		return cn, true, nil
+	}
+	c.mu.Unlock()
+
+	cn, err := c.dial(key, u, deadline)
+	return cn, false, err
+}
+
+func (c *Client) dial(key string, u *url.URL, deadline time.Time) (*conn, error) {
+	dialTimeout := c.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout, Deadline: deadline}
+	nc, err := dialer.Dial("tcp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "https" {
+		cfg := &tls.Config{}
+		if c.TLSConfig != nil {
+			cfg = c.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(nc, cfg)
+		handshakeDeadline := time.Now().Add(dialTimeout)
+		if !deadline.IsZero() && deadline.Before(handshakeDeadline) {
+			handshakeDeadline = deadline
+		}
+		tlsConn.SetDeadline(handshakeDeadline)
+		if err := tlsConn.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tlsConn
+	}
+
+	return &conn{Conn: nc, key: key, parser: response.NewParser(nc)}, nil
+}
+
+// release puts cn back in the pool when keep is set and there is room,
+// and closes it otherwise.
+func (c *Client) release(cn *conn, keep bool) {
+	if !keep {
+		cn.Close()
+		return
+	}
+	maxIdle := c.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdleConnsPerHost
+	}
+
+	cn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[cn.key]) >= maxIdle {
+		cn.Close()
+		return
+	}
+	if c.idle == nil {
+		c.idle = make(map[string][]*conn)
+	}
+	cn.idleSince = time.Now()
+	c.idle[cn.key] = append(c.idle[cn.key], cn)
+}
+
+// CloseIdleConnections closes the connections kept for later requests.
+// Connections in use are left alone.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conns := range c.idle {
+		for _, cn := range conns {
+			cn.Close()
+		}
+	}
+	c.idle = nil
+}
+
+// body is the Body of a response with one. The connection goes back to the
+// pool once it has been read to EOF; closing it before that closes the
+// connection, as the rest could be any length.
+type body struct {
+	io.ReadCloser
+	client *Client
+	conn   *conn
+	keep   bool
+	done   bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.done = true
+		b.client.release(b.conn, b.keep)
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+// redirectRequest returns the request that follows the redirect resp, or nil
+// if resp is not one that can be followed. RFC 9110 15.4
+func redirectRequest(req *request.Request, resp *response.Response) *request.Request {
+	method := req.RequestLine.Method
+	switch resp.StatusLine.StatusCode {
+	case response.StatusMovedPermanently, response.StatusFound:
+		if method == "POST" { // what browsers have always done
+			method = "GET"
+		}
+	case response.StatusSeeOther:
+		if method != "HEAD" {
+			method = "GET"
+		}
+	case response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+
+	location, ok := resp.Headers.Get("Location")
+	if !ok {
+		return nil
+	}
+	u, err := req.URL.Parse(location)
+	if err != nil {
+		return nil
+	}
+	sameMethod := method == req.RequestLine.Method
+	if sameMethod && req.Body != nil && req.Body != request.NoBody {
+		return nil
+	}
+
+	next, err := request.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil
+	}
+	sameHost := u.Host == req.URL.Host
+	for _, f := range req.Headers.Fields() {
+		switch strings.ToLower(f.Name) {
+		case "host", "content-length", "transfer-encoding":
+			continue
+		case "content-type", "content-encoding", "content-language", "content-location":
+			if !sameMethod { // the content is gone
+				continue
+			}
+		case "authorization", "cookie", "proxy-authorization":
+			if !sameHost { // credentials stay with the host they were meant for
+				continue
+			}
+		}
+		next.Headers.Add(f.Name, f.Value)
+	}
+	return next
+}
+
+// replayable reports whether req can be sent again without asking: it is
+// idempotent and has no body that would have to be read twice.
+func replayable(req *request.Request) bool {
+	switch req.RequestLine.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return req.Body == nil || req.Body == request.NoBody
+	default:
+		return false
+	}
+}
+
+// closedByServer reports whether err means the connection was closed before
+// a response started.
+func closedByServer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func hasCloseOption(req *request.Request) bool {
+	connection, _ := req.Headers.Get("Connection")
+	for _, option := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort returns the host and port of u, the port defaulting to that of its scheme.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,352 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+	"github.com/livingpool/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves handler on a free port and returns its base URL.
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + srv.Listener.Addr().String()
+}
+
+func testHandler(w *response.Writer, req *request.Request) {
+	switch req.Path() {
+	case "/hello":
+		w.Write([]byte("hello, world"))
+	case "/echo":
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteStatusLine(response.StatusBadRequest)
+			return
+		}
+		transferEncoding, _ := req.Headers.Get("Transfer-Encoding")
+		trailer, _ := req.Trailers.Get("X-Checksum")
+		contentType, _ := req.Headers.Get("Content-Type")
+		fmt.Fprintf(w, "%s %d %q %q %q %s", req.RequestLine.Method, req.ContentLength, transferEncoding, trailer, contentType, body)
+	case "/stream":
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("Trailer", "X-Count")
+		w.WriteHeaders(h)
+		cw := response.NewChunkedWriterSize(w, 8)
+		for i := range 5 {
+			fmt.Fprintf(cw, "line %d\n", i)
+		}
+		cw.Trailers = headers.NewHeaders()
+		cw.Trailers.Set("X-Count", "5")
+		cw.Close()
+	case "/redirect":
+		redirect(w, response.StatusFound, "/hello")
+	case "/see-other":
+		redirect(w, response.StatusSeeOther, "/echo")
+	case "/temporary":
+		redirect(w, response.StatusTemporaryRedirect, "/echo")
+	case "/loop":
+		redirect(w, response.StatusFound, "/loop")
+	case "/slow":
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("too late"))
+	default:
+		w.WriteStatusLine(response.StatusNotFound)
+	}
+}
+
+func redirect(w *response.Writer, code response.StatusCode, location string) {
+	w.WriteStatusLine(code)
+	h := headers.NewHeaders()
+	h.Set("Location", location)
+	w.WriteHeaders(h)
+	w.Write([]byte("moved"))
+}
+
+func readBody(t *testing.T, resp *response.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+func TestClient(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+	defer c.CloseIdleConnections()
+
+	// Test: GET
+	resp, err := c.Get(base + "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, int64(12), resp.ContentLength)
+	assert.Equal(t, "hello, world", readBody(t, resp))
+
+	// Test: Error statuses are responses, not errors
+	resp, err = c.Get(base + "/missing")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+	readBody(t, resp)
+
+	// Test: Body of a known length
+	req, err := request.NewRequest("POST", base+"/echo", strings.NewReader("name=value"))
+	require.NoError(t, err)
+	req.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, `POST 10 "" "" "application/x-www-form-urlencoded" name=value`, readBody(t, resp))
+
+	// Test: Streamed body with trailers
+	pr, pw := io.Pipe()
+	go func() {
+		for i := range 3 {
+			fmt.Fprintf(pw, "part %d;", i)
+		}
+		pw.Close()
+	}()
+	req, err = request.NewRequest("PUT", base+"/echo", pr)
+	require.NoError(t, err)
+	req.Trailers.Set("X-Checksum", "abc")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, `PUT -1 "chunked" "abc" "" part 0;part 1;part 2;`, readBody(t, resp))
+
+	// Test: Chunked response with trailers
+	resp, err = c.Get(base + "/stream")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"line 0", "line 1", "line 2", "line 3", "line 4"}, lines)
+	count, _ := resp.Trailers.Get("X-Count")
+	assert.Equal(t, "5", count)
+
+	// Test: HEAD has no body
+	req, err = request.NewRequest("HEAD", base+"/hello", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), resp.ContentLength)
+	assert.Equal(t, request.NoBody, resp.Body)
+}
+
+func TestClientPool(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+	defer c.CloseIdleConnections()
+	key := "http://" + strings.TrimPrefix(base, "http://")
+
+	// Test: The connection is kept once the body has been read
+	resp, err := c.Get(base + "/hello")
+	require.NoError(t, err)
+	assert.Empty(t, c.idle[key])
+	readBody(t, resp)
+	require.Len(t, c.idle[key], 1)
+	first := c.idle[key][0]
+
+	// Test: And used for the next request
+	resp, err = c.Get(base + "/stream")
+	require.NoError(t, err)
+	assert.Empty(t, c.idle[key])
+	readBody(t, resp)
+	require.Len(t, c.idle[key], 1)
+	assert.Same(t, first, c.idle[key][0])
+
+	// Test: A body closed halfway closes its connection
+	resp, err = c.Get(base + "/stream")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Empty(t, c.idle[key])
+
+	// Test: Connection: close is honoured
+	req, err := request.NewRequest("GET", base+"/hello", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Connection", "close")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Empty(t, c.idle[key])
+
+	// Test: Idle connections expire
+	c.IdleTimeout = time.Nanosecond
+	resp, err = c.Get(base + "/hello")
+	require.NoError(t, err)
+	readBody(t, resp)
+	require.Len(t, c.idle[key], 1)
+	stale := c.idle[key][0]
+	time.Sleep(time.Millisecond)
+	resp, err = c.Get(base + "/hello")
+	require.NoError(t, err)
+	readBody(t, resp)
+	require.Len(t, c.idle[key], 1)
+	assert.NotSame(t, stale, c.idle[key][0])
+}
+
+func TestClientRetriesClosedConnection(t *testing.T) {
+	// a server that answers one request per connection, then hangs up
+	// without saying so
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			req, err := request.RequestFromReader(conn)
+			if err == nil {
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(req.Path()), req.Path())
+			}
+			conn.Close()
+		}
+	}()
+
+	c := New()
+	defer c.CloseIdleConnections()
+	base := "http://" + ln.Addr().String()
+
+	// Test: A GET is sent again on a new connection
+	resp, err := c.Get(base + "/first")
+	require.NoError(t, err)
+	assert.Equal(t, "/first", readBody(t, resp))
+	resp, err = c.Get(base + "/second")
+	require.NoError(t, err)
+	assert.Equal(t, "/second", readBody(t, resp))
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: A POST is not
+	req, err := request.NewRequest("POST", base+"/third", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	require.Error(t, err)
+}
+
+func TestClientRedirects(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+	defer c.CloseIdleConnections()
+
+	// Test: Redirect followed
+	resp, err := c.Get(base + "/redirect")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "hello, world", readBody(t, resp))
+
+	// Test: 303 turns a POST into a GET without the body
+	req, err := request.NewRequest("POST", base+"/see-other", strings.NewReader("data"))
+	require.NoError(t, err)
+	req.Headers.Set("Content-Type", "text/plain")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, `GET 0 "" "" "" `, readBody(t, resp))
+
+	// Test: 307 keeps the method, so a body cannot follow it
+	req, err = request.NewRequest("POST", base+"/temporary", strings.NewReader("data"))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusTemporaryRedirect, resp.StatusLine.StatusCode)
+	assert.Equal(t, "moved", readBody(t, resp))
+
+	// Test: 307 keeps the method
+	req, err = request.NewRequest("DELETE", base+"/temporary", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, `DELETE 0 "" "" "" `, readBody(t, resp))
+
+	// Test: Redirect loop
+	_, err = c.Get(base + "/loop")
+	require.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: Redirects not followed
+	c.MaxRedirects = -1
+	resp, err = c.Get(base + "/redirect")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+	location, _ := resp.Headers.Get("Location")
+	assert.Equal(t, "/hello", location)
+	readBody(t, resp)
+}
+
+func TestRedirectRequest(t *testing.T) {
+	redirectTo := func(code response.StatusCode, location string) *response.Response {
+		h := headers.NewHeaders()
+		h.Set("Location", location)
+		return &response.Response{StatusLine: response.StatusLine{StatusCode: code}, Headers: h}
+	}
+
+	req, err := request.NewRequest("GET", "http://example.com/a/b?q=1", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Authorization", "Bearer secret")
+	req.Headers.Set("Accept", "text/html")
+
+	// Test: Relative location
+	next := redirectRequest(req, redirectTo(response.StatusMovedPermanently, "c"))
+	require.NotNil(t, next)
+	assert.Equal(t, "http://example.com/a/c", next.URL.String())
+	auth, _ := next.Headers.Get("Authorization")
+	assert.Equal(t, "Bearer secret", auth)
+
+	// Test: Credentials stay with their host
+	next = redirectRequest(req, redirectTo(response.StatusPermanentRedirect, "https://other.example/"))
+	require.NotNil(t, next)
+	host, _ := next.Headers.Get("Host")
+	assert.Equal(t, "other.example", host)
+	_, hasAuth := next.Headers.Get("Authorization")
+	assert.False(t, hasAuth)
+	accept, _ := next.Headers.Get("Accept")
+	assert.Equal(t, "text/html", accept)
+
+	// Test: Not redirects
+	assert.Nil(t, redirectRequest(req, redirectTo(response.StatusOK, "/x")))
+	assert.Nil(t, redirectRequest(req, redirectTo(response.StatusMultipleChoices, "/x")))
+	assert.Nil(t, redirectRequest(req, &response.Response{StatusLine: response.StatusLine{StatusCode: response.StatusFound}, Headers: headers.NewHeaders()}))
+	assert.Nil(t, redirectRequest(req, redirectTo(response.StatusFound, "ftp://example.com/")))
+}
+
+func TestClientTimeout(t *testing.T) {
+	base := startServer(t, testHandler)
+
+	// Test: Slow response
+	c := New(WithTimeout(50 * time.Millisecond))
+	_, err := c.Get(base + "/slow")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+
+	// Test: Fast enough
+	resp, err := c.Get(base + "/hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", readBody(t, resp))
+	c.CloseIdleConnections()
+
+	// Test: Bad URLs
+	_, err = c.Get("ftp://example.com/")
+	require.ErrorIs(t, err, request.ErrInvalidTarget)
+	_, err = c.Get("/relative")
+	require.ErrorIs(t, err, request.ErrInvalidTarget)
+}
@@ -0,0 +1,242 @@
+package headers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Accept is a single element of an Accept, Accept-Language or Accept-Encoding
+// field: a media range, language range or content coding with its weight.
+type Accept struct {
+	// Value is the range or coding in lower case, e.g. "text/*", "en-us" or "gzip".
+	Value string
+	// Params holds the parameters other than q, with lower case names. Nil if there are none.
+	Params map[string]string
+	// Q is the weight from 0 to 1. 0 means not acceptable. RFC 9110 12.4.2
+	Q float64
+}
+
+// Accept parses the key field as a list of Accept elements. Malformed
+// elements are left out.
+func (h *Headers) Accept(key string) []Accept {
+	val, _ := h.Get(key)
+	return ParseAccept(val)
+}
+
+// ParseAccept parses a comma separated list of ranges or codings, each with
+// optional parameters and a q weight. Elements with a malformed value or
+// weight are left out.
+func ParseAccept(value string) []Accept {
+	var accepts []Accept
+	for _, elem := range splitQuoted(value, ',') {
+		parts := splitQuoted(elem, ';')
+		a := Accept{Value: strings.ToLower(strings.Trim(parts[0], " \t")), Q: 1}
+		if a.Value == "" {
+			continue
+		}
+		valid := true
+		for _, param := range parts[1:] {
+			name, val, ok := strings.Cut(strings.Trim(param, " \t"), "=")
+			name = strings.ToLower(strings.TrimRight(name, " \t"))
+			val = strings.TrimLeft(val, " \t")
+			if !ok || !IsToken(name) {
+				valid = false
+				break
+			}
+			if name == "q" {
+				q, ok := parseQ(val)
+				if !ok {
+					valid = false
+					break
+				}
+				a.Q = q
+				continue
+			}
+			if a.Params == nil {
+				a.Params = make(map[string]string)
+			}
+			a.Params[name] = unquote(val)
+		}
+		if valid {
+			accepts = append(accepts, a)
+		}
+	}
+	return accepts
+}
+
+// NegotiateContentType returns the offered media type the Accept field likes
+// best, or "" if none is acceptable. Each offer takes the weight of the most
+// specific media range matching it, so "text/html" beats "text/*" which beats
+// "*/*". Ties go to the offer listed first. Without an Accept field the first
+// offer is returned. RFC 9110 12.5.1
+func (h *Headers) NegotiateContentType(offers ...string) string {
+	if _, ok := h.Get("Accept"); !ok {
+		return first(offers)
+	}
+	return negotiate(h.Accept("Accept"), offers, matchMediaRange, 0)
+}
+
+// NegotiateLanguage returns the offered language tag the Accept-Language field
+// likes best, or "" if none is acceptable. A range matches a tag equal to it
+// or starting with it followed by "-", so "en" matches "en-US". The longest
+// matching range sets the weight. RFC 9110 12.5.4 and RFC 4647 3.3.1
+func (h *Headers) NegotiateLanguage(offers ...string) string {
+	if _, ok := h.Get("Accept-Language"); !ok {
+		return first(offers)
+	}
+	return negotiate(h.Accept("Accept-Language"), offers, matchLanguageRange, 0)
+}
+
+// NegotiateEncoding returns the offered content coding the Accept-Encoding
+// field likes best, or "" if none is acceptable. "identity" stands for no
+// coding and is acceptable unless the field rules it out, either by name or
+// with "*;q=0". RFC 9110 12.5.3
+func (h *Headers) NegotiateEncoding(offers ...string) string {
+	if _, ok := h.Get("Accept-Encoding"); !ok {
+		return first(offers)
+	}
+	return negotiate(h.Accept("Accept-Encoding"), offers, matchCoding, 1)
+}
+
+// negotiate picks the offer with the highest weight. match returns how
+// specific a range is for an offer, or -1 if it does not match. An offer no
+// range matches gets weight identityQ if it is "identity", and 0 otherwise.
+func negotiate(accepts []Accept, offers []string, match func(Accept, string) int, identityQ float64) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		if strings.EqualFold(offer, "identity") {
+			q = identityQ
+		}
+		for _, a := range accepts {
+			if s := match(a, offer); s > specificity {
+				q, specificity = a.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// matchMediaRange ranks "*/*" 0, "type/*" 1, "type/subtype" 2, and
+// "type/subtype" with parameters 3 plus the number of parameters.
+func matchMediaRange(a Accept, offer string) int {
+	offerType, offerParams := parseMediaType(offer)
+	typ, subtype, _ := strings.Cut(a.Value, "/")
+	oTyp, oSubtype, _ := strings.Cut(offerType, "/")
+	switch {
+	case typ == "*" && subtype == "*":
+		return 0
+	case typ != oTyp:
+		return -1
+	case subtype == "*":
+		return 1
+	case subtype != oSubtype:
+		return -1
+	}
+	for name, val := range a.Params {
+		if offerParams[name] != val {
+			return -1
+		}
+	}
+	if len(a.Params) > 0 {
+		return 3 + len(a.Params)
+	}
+	return 2
+}
+
+// matchLanguageRange ranks "*" 0 and any other range by its length.
+func matchLanguageRange(a Accept, offer string) int {
+	offer = strings.ToLower(offer)
+	switch {
+	case a.Value == "*":
+		return 0
+	case offer == a.Value || strings.HasPrefix(offer, a.Value+"-"):
+		return len(a.Value)
+	default:
+		return -1
+	}
+}
+
+// matchCoding ranks "*" 0 and a coding of the same name 1.
+func matchCoding(a Accept, offer string) int {
+	switch {
+	case a.Value == "*":
+		return 0
+	case strings.EqualFold(offer, a.Value):
+		return 1
+	default:
+		return -1
+	}
+}
+
+// parseMediaType splits a media type like "text/html; charset=utf-8" into its
+// lower case type and its parameters.
+func parseMediaType(s string) (string, map[string]string) {
+	parts := splitQuoted(s, ';')
+	params := make(map[string]string)
+	for _, param := range parts[1:] {
+		name, val, _ := strings.Cut(strings.Trim(param, " \t"), "=")
+		params[strings.ToLower(strings.TrimRight(name, " \t"))] = unquote(strings.TrimLeft(val, " \t"))
+	}
+	return strings.ToLower(strings.Trim(parts[0], " \t")), params
+}
+
+// parseQ parses a weight: "0" or "1", or either followed by "." and up to
+// three digits, no greater than 1. RFC 9110 12.4.2
+func parseQ(s string) (float64, bool) {
+	intPart, frac, hasDot := strings.Cut(s, ".")
+	if intPart != "0" && intPart != "1" || len(frac) > 3 || hasDot && strings.Trim(frac, "0123456789") != "" {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// splitQuoted splits s at each sep that is not inside a quoted string.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the content of a quoted string with its escapes removed,
+// or s itself if it is not quoted. RFC 9110 5.6.4
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func first(offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	return offers[0]
+}
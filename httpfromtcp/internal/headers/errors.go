@@ -0,0 +1,21 @@
+package headers
+
+import "errors"
+
+var (
+	// ErrInvalidToken is returned for a field name that is not a valid token.
+	ErrInvalidToken = errors.New("invalid header token")
+	// ErrMalformedFieldLine is returned for a field line without a colon,
+	// or with whitespace between the field name and the colon.
+	ErrMalformedFieldLine = errors.New("malformed field line")
+	// ErrInvalidFieldValue is returned for a field value holding CR, LF, NUL
+	// or another control character.
+	ErrInvalidFieldValue = errors.New("invalid field value")
+	// ErrObsFold is returned for a folded field line when folding is rejected.
+	ErrObsFold = errors.New("obsolete line folding")
+	// ErrInvalidStructuredField is returned for a field value that does not parse
+	// as the structured field type asked for, or a value that cannot be serialized.
+	ErrInvalidStructuredField = errors.New("invalid structured field")
+	// ErrHeaderTooLarge is returned when the header section is larger than allowed.
+	ErrHeaderTooLarge = errors.New("header too large")
+)
@@ -3,73 +3,284 @@ package headers
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
+	"time"
 )
 
-type Headers map[string]string
+// Field is a single field line. Name keeps the casing it was received or added with.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers is a header or trailer section. It keeps every field line in order,
+// so repeated fields such as Set-Cookie survive untouched. Field names are
+// matched case-insensitively.
+type Headers struct {
+	fields []Field
+}
 
-func NewHeaders() Headers {
-	return make(Headers)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
 const crlf = "\r\n"
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// TimeFormat is the layout of HTTP dates such as Date and Last-Modified,
+// always in GMT. Format a time.Time in UTC with it. RFC 9110 5.6.7
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// timeFormats are the layouts a recipient must accept for HTTP dates: the
+// IMF-fixdate senders generate, and the obsolete RFC 850 and asctime forms.
+var timeFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// ParseTime parses an HTTP date in any of the three formats of RFC 9110 5.6.7.
+func ParseTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range timeFormats {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// ObsFold is what the parser does with obsolete line folding: a field line
+// starting with whitespace, continuing the value of the previous field. RFC 9112 5.2
+type ObsFold int
+
+const (
+	// ObsFoldReject fails the parse with ErrObsFold.
+	ObsFoldReject ObsFold = iota
+	// ObsFoldReplace joins the continuation line to the previous value with a single SP.
+	ObsFoldReplace
+)
+
+// ParseOptions configures ParseWithOptions. The zero value sets no limits and rejects obs-fold.
+type ParseOptions struct {
+	// MaxBytes is the most bytes the next field line may take, CRLF included.
+	MaxBytes int
+	// MaxFields is the most field lines h may hold.
+	MaxFields int
+	// ObsFold is how folded field lines are handled.
+	ObsFold ObsFold
+}
+
+// Parse parses a single field line from data, or the empty line that ends the header section.
+// It returns 0 bytes parsed when data does not hold a complete line yet.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.ParseWithOptions(data, ParseOptions{})
+}
+
+// ParseWithOptions is like Parse, but fails with ErrHeaderTooLarge when the field line is
+// longer than opts.MaxBytes or would add more than opts.MaxFields fields to h.
+func (h *Headers) ParseWithOptions(data []byte, opts ParseOptions) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
+		if opts.MaxBytes > 0 && len(data) > opts.MaxBytes {
+			return 0, false, fmt.Errorf("%w: field line longer than %d bytes", ErrHeaderTooLarge, opts.MaxBytes)
+		}
 		return 0, false, nil
 	}
 
+	if opts.MaxBytes > 0 && idx+2 > opts.MaxBytes {
+		return 0, false, fmt.Errorf("%w: field line longer than %d bytes", ErrHeaderTooLarge, opts.MaxBytes)
+	}
+
 	if idx == 0 { // headers are done, consume the CRLF
 		return 2, true, nil
 	}
 
-	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	line := data[:idx]
+	if bytes.ContainsAny(line, "\r\n") {
+		return 0, false, fmt.Errorf("%w: bare CR or LF", ErrMalformedFieldLine)
+	}
+
+	// whitespace starts an obs-fold, except in front of the first line, where
+	// it would hide a field from some parsers and not others. RFC 9112 2.2
+	if line[0] == ' ' || line[0] == '\t' {
+		if len(h.fields) == 0 {
+			return 0, false, fmt.Errorf("%w: whitespace before the first field line", ErrMalformedFieldLine)
+		}
+		if err := h.unfold(line, opts.ObsFold); err != nil {
+			return 0, false, err
+		}
+		return idx + 2, false, nil
+	}
+
+	parts := bytes.SplitN(line, []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("%w: missing colon: %s", ErrMalformedFieldLine, line)
+	}
 	key := string(parts[0])
 
-	if key != strings.TrimRight(key, " ") {
-		return 0, false, fmt.Errorf("space after field name: %s", key)
+	if key != strings.TrimRight(key, " \t") {
+		return 0, false, fmt.Errorf("%w: space after field name: %s", ErrMalformedFieldLine, key)
 	}
 
-	val := bytes.TrimSpace(parts[1])
-	key = strings.TrimSpace(key)
-	if !validTokens([]byte(key)) {
-		return 0, false, fmt.Errorf("invalid header token found: %s", key)
+	// only SP and HTAB are whitespace here, anything else is part of the field
+	val := bytes.Trim(parts[1], " \t")
+	if !IsToken(key) {
+		return 0, false, fmt.Errorf("%w: %s", ErrInvalidToken, key)
+	}
+	if !validFieldValue(val) {
+		return 0, false, fmt.Errorf("%w: in %s", ErrInvalidFieldValue, key)
 	}
 
-	h.Set(key, string(val))
+	if opts.MaxFields > 0 && len(h.fields) >= opts.MaxFields {
+		return 0, false, fmt.Errorf("%w: more than %d fields", ErrHeaderTooLarge, opts.MaxFields)
+	}
+	h.Add(key, string(val))
 
 	return idx + 2, false, nil
 }
 
-func (h Headers) Set(key, value string) {
-	key = strings.ToLower(key)
-	existingVal, exists := h[key]
-	if exists {
-		value = existingVal + ", " + value
+// unfold appends an obs-fold continuation line to the value of the last field.
+func (h *Headers) unfold(line []byte, mode ObsFold) error {
+	if mode != ObsFoldReplace {
+		return ErrObsFold
+	}
+
+	val := bytes.Trim(line, " \t")
+	if !validFieldValue(val) {
+		return fmt.Errorf("%w: in folded line", ErrInvalidFieldValue)
+	}
+
+	last := &h.fields[len(h.fields)-1]
+	switch {
+	case len(val) == 0:
+	case last.Value == "":
+		last.Value = string(val)
+	default:
+		last.Value += " " + string(val)
 	}
-	h[key] = value
+	return nil
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	key = strings.ToLower(key)
-	val, exists := h[key]
-	return val, exists
+// Get returns the combined value of all key fields, joined with ", ",
+// and whether there was any. RFC 9110 5.3
+// Use Values for fields that cannot be combined, such as Set-Cookie.
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ", "), true
 }
 
-func (h Headers) Override(key, value string) {
-	key = strings.ToLower(key)
-	h[key] = value
+// Values returns the values of all key fields, in order.
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
 }
 
-func (h Headers) Delete(key string) {
-	key = strings.ToLower(key)
-	delete(h, key)
+// Add appends a key field, after any existing ones.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: key, Value: value})
+}
+
+// Set replaces all key fields with a single one. It takes the place of the
+// first existing key field, or goes at the end if there was none.
+func (h *Headers) Set(key, value string) {
+	idx := slices.IndexFunc(h.fields, func(f Field) bool {
+		return strings.EqualFold(f.Name, key)
+	})
+	if idx == -1 {
+		h.Add(key, value)
+		return
+	}
+	h.fields[idx] = Field{Name: key, Value: value}
+	rest := slices.DeleteFunc(h.fields[idx+1:], func(f Field) bool {
+		return strings.EqualFold(f.Name, key)
+	})
+	h.fields = h.fields[:idx+1+len(rest)]
+}
+
+// Del removes all key fields.
+func (h *Headers) Del(key string) {
+	h.fields = slices.DeleteFunc(h.fields, func(f Field) bool {
+		return strings.EqualFold(f.Name, key)
+	})
+}
+
+// Override is the same as Set.
+func (h *Headers) Override(key, value string) {
+	h.Set(key, value)
+}
+
+// Delete is the same as Del.
+func (h *Headers) Delete(key string) {
+	h.Del(key)
+}
+
+// Clone returns a copy of h.
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.fields)}
+}
+
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// Fields returns a copy of the field lines, in order.
+func (h *Headers) Fields() []Field {
+	return slices.Clone(h.fields)
+}
+
+// WriteTo writes the field lines in order, in their wire format with
+// canonical names, e.g. "Content-Type: text/html\r\n". It does not
+// write the empty line that ends a header section.
+func (h *Headers) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range h.fields {
+		buf.WriteString(CanonicalName(f.Name))
+		buf.WriteString(": ")
+		buf.WriteString(f.Value)
+		buf.WriteString(crlf)
+	}
+	return buf.WriteTo(w)
+}
+
+// CanonicalName returns the canonical casing of a field name: the first
+// letter and each letter following a hyphen upper case, the rest lower
+// case, e.g. "content-type" becomes "Content-Type".
+func CanonicalName(name string) string {
+	b := []byte(name)
+	upper := true
+	for i, c := range b {
+		switch {
+		case upper && c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case !upper && c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
+	}
+	return string(b)
 }
 
 // RFC 9110 5.1 and 5.6.2
 var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
 
+// IsToken reports whether s is a non-empty token, the grammar of field names,
+// methods, transfer codings and parameter names. RFC 9110 5.6.2
+func IsToken(s string) bool {
+	return s != "" && validTokens([]byte(s))
+}
+
 // validTokens checks if the data contains only valid tokens
 // or characters that are allowed in a token
 func validTokens(data []byte) bool {
@@ -77,7 +288,19 @@ func validTokens(data []byte) bool {
 		if !(c >= 'A' && c <= 'Z' ||
 			c >= 'a' && c <= 'z' ||
 			c >= '0' && c <= '9' ||
-			c == '-') {
+			slices.Contains(tokenChars, c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validFieldValue checks that a field value with its surrounding whitespace
+// removed holds only visible characters, SP, HTAB and obs-text. That rules out
+// CR, LF and NUL along with every other control character. RFC 9110 5.5
+func validFieldValue(val []byte) bool {
+	for _, c := range val {
+		if c < ' ' && c != '\t' || c == 0x7f {
 			return false
 		}
 	}
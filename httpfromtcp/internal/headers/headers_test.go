@@ -1,7 +1,9 @@
 package headers
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -14,28 +16,37 @@ func TestParseHeaders(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
-	// Test: Valid single header with extra whitespace
+	// Test: Whitespace before the first field line
 	headers = NewHeaders()
 	data = []byte("       Host: localhost:42069                           \r\n\r\n")
 	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+	assert.Equal(t, 0, headers.Len())
+
+	// Test: Valid single header with extra whitespace around the value
+	headers = NewHeaders()
+	data = []byte("Host:        localhost:42069                           \r\n\r\n")
+	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 57, n)
 	assert.False(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, headers.Values("user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -45,7 +56,7 @@ func TestParseHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Empty(t, headers)
+	assert.Equal(t, 0, headers.Len())
 	assert.Equal(t, 2, n)
 	assert.True(t, done)
 
@@ -55,24 +66,28 @@ func TestParseHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// Test: Multiple values for a single header key
-	headers = map[string]string{"set-person": "prime-loves-zig"}
+	headers = NewHeaders()
+	headers.Add("Set-Person", "prime-loves-zig")
 	data = []byte("Set-Person: tj-loves-ocaml\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "prime-loves-zig, tj-loves-ocaml", headers["set-person"])
+	assert.Equal(t, []string{"prime-loves-zig", "tj-loves-ocaml"}, headers.Values("set-person"))
+	val, exists := headers.Get("set-person")
+	assert.True(t, exists)
+	assert.Equal(t, "prime-loves-zig, tj-loves-ocaml", val)
 	assert.False(t, done)
 
 	// Test: Invalid spacing header
 	headers = NewHeaders()
 	data = []byte("       Host : localhost:42069       \r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
@@ -80,7 +95,311 @@ func TestParseHeaders(t *testing.T) {
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Valid special characters in header key
+	headers = NewHeaders()
+	data = []byte("X_Custom: 1\r\nAccept!: 2\r\n#$%&'*+-.^_`|~: 3\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, 13, n)
+	n, _, err = headers.Parse(data[13:])
+	require.NoError(t, err)
+	assert.Equal(t, 12, n)
+	_, _, err = headers.Parse(data[25:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, headers.Values("x_custom"))
+	assert.Equal(t, []string{"2"}, headers.Values("accept!"))
+	assert.Equal(t, []string{"3"}, headers.Values("#$%&'*+-.^_`|~"))
+
+	// Test: Invalid delimiters in header key
+	for _, key := range []string{"X(Custom)", "X,Y", "X/Y", "X@Y", "X\"Y", "X{Y}", "X\x00Y"} {
+		headers = NewHeaders()
+		data = []byte(key + ": 1\r\n\r\n")
+		_, _, err = headers.Parse(data)
+		require.ErrorIs(t, err, ErrInvalidToken, key)
+	}
+
+	// Test: Valid field values with obs-text and inner whitespace
+	headers = NewHeaders()
+	data = []byte("X-Name: caf\xc3\xa9 \t au lait\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"caf\xc3\xa9 \t au lait"}, headers.Values("x-name"))
+
+	// Test: Invalid characters in field value
+	for _, val := range []string{"a\x00b", "a\rb", "\x01", "a\x1fb", "a\x7fb", "\x0b5"} {
+		headers = NewHeaders()
+		data = []byte("X-Value: " + val + "\r\n\r\n")
+		n, _, err = headers.Parse(data)
+		assert.Equal(t, 0, n)
+		require.Error(t, err, "%q", val)
+	}
+
+	// Test: Empty field name
+	headers = NewHeaders()
+	data = []byte(": localhost:42069\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrInvalidToken)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Missing colon
+	headers = NewHeaders()
+	data = []byte("Host\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestParseHeadersWithOptions(t *testing.T) {
+	// Test: Field line within MaxBytes
+	headers := NewHeaders()
+	data := []byte("Host: localhost:42069\r\n\r\n")
+	n, done, err := headers.ParseWithOptions(data, ParseOptions{MaxBytes: 23})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, 23, n)
+	assert.False(t, done)
+
+	// Test: Complete field line over MaxBytes
+	headers = NewHeaders()
+	data = []byte("Host: localhost:42069\r\n\r\n")
+	n, done, err = headers.ParseWithOptions(data, ParseOptions{MaxBytes: 22})
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Incomplete field line already over MaxBytes
+	headers = NewHeaders()
+	data = []byte("X-Never-Ending: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	n, done, err = headers.ParseWithOptions(data, ParseOptions{MaxBytes: 32})
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Incomplete field line within MaxBytes needs more data
+	headers = NewHeaders()
+	data = []byte("X-Never-Ending: aaaa")
+	n, done, err = headers.ParseWithOptions(data, ParseOptions{MaxBytes: 32})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: New field over MaxFields
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
+	headers.Add("Accept", "*/*")
+	data = []byte("User-Agent: curl/7.81.0\r\n\r\n")
+	n, done, err = headers.ParseWithOptions(data, ParseOptions{MaxFields: 2})
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Repeated field counts as another field
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
+	headers.Add("Accept", "*/*")
+	data = []byte("Accept: text/html\r\n\r\n")
+	n, done, err = headers.ParseWithOptions(data, ParseOptions{MaxFields: 2})
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHeadersFields(t *testing.T) {
+	// Test: Repeated fields keep their order and casing
+	headers := NewHeaders()
+	data := []byte("Set-Cookie: a=1; Path=/\r\nx-request-id: 42\r\nSET-COOKIE: b=2, c=3\r\n\r\n")
+	for {
+		n, done, err := headers.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, 3, headers.Len())
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, c=3"}, headers.Values("set-cookie"))
+	assert.Equal(t, []Field{
+		{Name: "Set-Cookie", Value: "a=1; Path=/"},
+		{Name: "x-request-id", Value: "42"},
+		{Name: "SET-COOKIE", Value: "b=2, c=3"},
+	}, headers.Fields())
+
+	// Test: Add appends, Set replaces in place
+	headers = NewHeaders()
+	headers.Add("Accept", "text/html")
+	headers.Add("Host", "localhost:42069")
+	headers.Add("accept", "*/*")
+	headers.Set("ACCEPT", "application/json")
+	assert.Equal(t, []Field{
+		{Name: "ACCEPT", Value: "application/json"},
+		{Name: "Host", Value: "localhost:42069"},
+	}, headers.Fields())
+	headers.Set("Content-Length", "0")
+	assert.Equal(t, "Content-Length", headers.Fields()[2].Name)
+
+	// Test: Del removes every field line
+	headers.Add("accept", "text/plain")
+	headers.Del("Accept")
+	val, exists := headers.Get("accept")
+	assert.False(t, exists)
+	assert.Equal(t, "", val)
+	assert.Nil(t, headers.Values("accept"))
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Fields returns a copy
+	fields := headers.Fields()
+	fields[0].Value = "changed"
+	val, _ = headers.Get("host")
+	assert.Equal(t, "localhost:42069", val)
+
+	// Test: Wire format is ordered with canonical names
+	headers = NewHeaders()
+	headers.Add("content-type", "text/html")
+	headers.Add("set-cookie", "a=1")
+	headers.Add("X-REQUEST-ID", "42")
+	headers.Add("set-cookie", "b=2")
+	var buf bytes.Buffer
+	n, err := headers.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "Content-Type: text/html\r\nSet-Cookie: a=1\r\nX-Request-Id: 42\r\nSet-Cookie: b=2\r\n", buf.String())
+	assert.Equal(t, int64(buf.Len()), n)
+}
+
+func TestCanonicalName(t *testing.T) {
+	assert.Equal(t, "Content-Type", CanonicalName("content-type"))
+	assert.Equal(t, "Content-Type", CanonicalName("CONTENT-TYPE"))
+	assert.Equal(t, "Www-Authenticate", CanonicalName("WWW-Authenticate"))
+	assert.Equal(t, "X-Custom_header", CanonicalName("x-custom_HEADER"))
+	assert.Equal(t, "Te", CanonicalName("te"))
+	assert.Equal(t, "", CanonicalName(""))
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, s := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",  // IMF-fixdate
+		"Sunday, 06-Nov-94 08:49:37 GMT", // obsolete RFC 850 format
+		"Sun Nov  6 08:49:37 1994",       // ANSI C's asctime() format
+	} {
+		got, err := ParseTime(s)
+		require.NoError(t, err, s)
+		assert.True(t, want.Equal(got), s)
+	}
+
+	_, err := ParseTime("06 Nov 1994")
+	assert.Error(t, err)
+	_, err = ParseTime("Sun, 06 Nov 1994 08:49:37 PST")
+	assert.Error(t, err)
+}
+
+func TestParseObsFold(t *testing.T) {
+	// Test: Obs-fold rejected by default
+	headers := NewHeaders()
+	headers.Add("X-Long", "first")
+	data := []byte(" second\r\n\r\n")
+	n, done, err := headers.Parse(data)
+	require.ErrorIs(t, err, ErrObsFold)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Obs-fold replaced with a single space
+	headers = NewHeaders()
+	headers.Add("X-Long", "first")
+	data = []byte(" \t second  \r\n\r\n")
+	n, done, err = headers.ParseWithOptions(data, ParseOptions{ObsFold: ObsFoldReplace})
+	require.NoError(t, err)
+	assert.Equal(t, 13, n)
+	assert.False(t, done)
+	assert.Equal(t, []string{"first second"}, headers.Values("x-long"))
+	assert.Equal(t, 1, headers.Len())
+
+	// Test: Obs-fold continuing an empty value
+	headers = NewHeaders()
+	headers.Add("X-Long", "")
+	data = []byte(" second\r\n\r\n")
+	_, _, err = headers.ParseWithOptions(data, ParseOptions{ObsFold: ObsFoldReplace})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"second"}, headers.Values("x-long"))
+
+	// Test: Obs-fold with an invalid value
+	headers = NewHeaders()
+	headers.Add("X-Long", "first")
+	data = []byte(" sec\x00ond\r\n\r\n")
+	_, _, err = headers.ParseWithOptions(data, ParseOptions{ObsFold: ObsFoldReplace})
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+}
+
+func TestParseAccept(t *testing.T) {
+	// Test: Weights, parameters and wildcards
+	accepts := ParseAccept(`text/html, application/xhtml+xml;q=0.9, text/plain; format="a;b" ;Q=0.5, */*;q=0`)
+	assert.Equal(t, []Accept{
+		{Value: "text/html", Q: 1},
+		{Value: "application/xhtml+xml", Q: 0.9},
+		{Value: "text/plain", Params: map[string]string{"format": "a;b"}, Q: 0.5},
+		{Value: "*/*", Q: 0},
+	}, accepts)
+
+	// Test: Malformed elements are left out
+	accepts = ParseAccept("gzip;q=2, br;q=0.1234, deflate;q=abc, , zstd;q=1.000, compress;=1")
+	assert.Equal(t, []Accept{{Value: "zstd", Q: 1}}, accepts)
+
+	// Test: Combined field lines
+	h := NewHeaders()
+	h.Add("Accept-Language", "da")
+	h.Add("Accept-Language", "en-GB;q=0.8")
+	assert.Equal(t, []Accept{{Value: "da", Q: 1}, {Value: "en-gb", Q: 0.8}}, h.Accept("accept-language"))
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		value  string
+		offers []string
+		want   string
+	}{
+		{"no Accept", "", "", []string{"text/html", "application/json"}, "text/html"},
+		{"browser", "Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", []string{"application/json", "text/html"}, "text/html"},
+		{"API client", "Accept", "application/json", []string{"text/html", "application/json"}, "application/json"},
+		{"anything ties to the first offer", "Accept", "*/*", []string{"text/plain", "application/json"}, "text/plain"},
+		{"type wildcard", "Accept", "image/*;q=0.5, text/*", []string{"image/png", "text/css"}, "text/css"},
+		{"specific range overrides wildcard", "Accept", "text/*, text/html;q=0.1", []string{"text/html", "text/plain"}, "text/plain"},
+		{"q=0 excludes", "Accept", "text/html;q=0, */*", []string{"text/html"}, ""},
+		{"media type parameters", "Accept", "text/html;level=1, text/html;q=0.2", []string{"text/html", "text/html;level=1"}, "text/html;level=1"},
+		{"case insensitive", "Accept", "Application/JSON", []string{"application/json"}, "application/json"},
+		{"nothing acceptable", "Accept", "image/png", []string{"text/html", "application/json"}, ""},
+		{"language prefix", "Accept-Language", "fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5", []string{"en-US", "fr"}, "fr"},
+		{"language longest range", "Accept-Language", "en;q=0.5, en-GB", []string{"en-US", "en-GB"}, "en-GB"},
+		{"language prefix at subtag boundary only", "Accept-Language", "en", []string{"eng", "en-US"}, "en-US"},
+		{"language wildcard", "Accept-Language", "da, *;q=0.1", []string{"de"}, "de"},
+		{"encoding", "Accept-Encoding", "gzip;q=0.8, br", []string{"gzip", "br"}, "br"},
+		{"identity implied", "Accept-Encoding", "br;q=0.5", []string{"gzip", "identity"}, "identity"},
+		{"identity by wildcard", "Accept-Encoding", "gzip, *;q=0", []string{"identity"}, ""},
+		{"identity by name", "Accept-Encoding", "identity;q=0", []string{"identity", "gzip"}, ""},
+		{"empty Accept-Encoding", "Accept-Encoding", "", []string{"gzip", "identity"}, "identity"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHeaders()
+			if tc.key != "" {
+				h.Add(tc.key, tc.value)
+			}
+			var got string
+			switch tc.key {
+			case "Accept-Language":
+				got = h.NegotiateLanguage(tc.offers...)
+			case "Accept-Encoding":
+				got = h.NegotiateEncoding(tc.offers...)
+			default:
+				got = h.NegotiateContentType(tc.offers...)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
 }
@@ -0,0 +1,710 @@
+package headers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Structured Field Values, RFC 8941. A bare item is one of
+//
+//	int64    Integer
+//	float64  Decimal
+//	string   String
+//	Token    Token
+//	[]byte   Byte Sequence
+//	bool     Boolean
+//
+// Serializing also accepts an int for an Integer.
+
+// Token is a bare item Token, as opposed to a String. RFC 8941 3.3.4
+type Token string
+
+// Item is a bare item with parameters. RFC 8941 3.3
+type Item struct {
+	Value  any
+	Params Params
+}
+
+// InnerList is a list of items with parameters of its own. RFC 8941 3.1.1
+type InnerList struct {
+	Items  []Item
+	Params Params
+}
+
+// Member is a List or Dictionary member: an Item or an InnerList.
+type Member interface {
+	member()
+}
+
+func (Item) member()      {}
+func (InnerList) member() {}
+
+// Param is a single parameter. Value is a bare item.
+type Param struct {
+	Key   string
+	Value any
+}
+
+// Params is an ordered set of parameters. RFC 8941 3.1.2
+type Params []Param
+
+// Get returns the value of the key parameter and whether there was one.
+func (p Params) Get(key string) (any, bool) {
+	for _, param := range p {
+		if param.Key == key {
+			return param.Value, true
+		}
+	}
+	return nil, false
+}
+
+// List is a List field value. RFC 8941 3.1
+type List []Member
+
+// DictMember is a single Dictionary member.
+type DictMember struct {
+	Key   string
+	Value Member
+}
+
+// Dictionary is an ordered map of keys to members. RFC 8941 3.2
+type Dictionary []DictMember
+
+// Get returns the key member and whether there was one.
+func (d Dictionary) Get(key string) (Member, bool) {
+	for _, m := range d {
+		if m.Key == key {
+			return m.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Item parses the key field as an Item. Several key fields are combined first,
+// which an Item does not allow, so that fails like a missing field does.
+func (h *Headers) Item(key string) (Item, error) {
+	val, _ := h.Get(key)
+	return ParseItem(val)
+}
+
+// List parses the key field as a List. A missing field is an empty List.
+func (h *Headers) List(key string) (List, error) {
+	val, _ := h.Get(key)
+	return ParseList(val)
+}
+
+// Dictionary parses the key field as a Dictionary. A missing field is an empty Dictionary.
+func (h *Headers) Dictionary(key string) (Dictionary, error) {
+	val, _ := h.Get(key)
+	return ParseDictionary(val)
+}
+
+// SetItem serializes item and sets it as the key field.
+func (h *Headers) SetItem(key string, item Item) error {
+	val, err := SerializeItem(item)
+	if err != nil {
+		return err
+	}
+	h.Set(key, val)
+	return nil
+}
+
+// SetList serializes l and sets it as the key field. An empty List removes the field,
+// since it cannot be serialized. RFC 8941 4.1.1
+func (h *Headers) SetList(key string, l List) error {
+	val, err := SerializeList(l)
+	if err != nil {
+		return err
+	}
+	if val == "" {
+		h.Del(key)
+		return nil
+	}
+	h.Set(key, val)
+	return nil
+}
+
+// SetDictionary serializes d and sets it as the key field. An empty Dictionary removes
+// the field, since it cannot be serialized. RFC 8941 4.1.2
+func (h *Headers) SetDictionary(key string, d Dictionary) error {
+	val, err := SerializeDictionary(d)
+	if err != nil {
+		return err
+	}
+	if val == "" {
+		h.Del(key)
+		return nil
+	}
+	h.Set(key, val)
+	return nil
+}
+
+// sfParser holds the input left to parse.
+type sfParser struct {
+	s string
+}
+
+func (p *sfParser) fail(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidStructuredField, fmt.Sprintf(format, args...))
+}
+
+func (p *sfParser) peek() byte {
+	if p.s == "" {
+		return 0
+	}
+	return p.s[0]
+}
+
+func (p *sfParser) skipSP() {
+	p.s = strings.TrimLeft(p.s, " ")
+}
+
+func (p *sfParser) skipOWS() {
+	p.s = strings.TrimLeft(p.s, " \t")
+}
+
+// ParseItem parses a field value as an Item. RFC 8941 4.2
+func ParseItem(s string) (Item, error) {
+	p := &sfParser{s: s}
+	p.skipSP()
+	item, err := p.item()
+	if err != nil {
+		return Item{}, err
+	}
+	p.skipSP()
+	if p.s != "" {
+		return Item{}, p.fail("trailing characters %q", p.s)
+	}
+	return item, nil
+}
+
+// ParseList parses a field value as a List. RFC 8941 4.2.1
+func ParseList(s string) (List, error) {
+	p := &sfParser{s: s}
+	p.skipSP()
+	var l List
+	for p.s != "" {
+		m, err := p.member()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, m)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ParseDictionary parses a field value as a Dictionary. A repeated key keeps
+// its first position and takes the last value. RFC 8941 4.2.2
+func ParseDictionary(s string) (Dictionary, error) {
+	p := &sfParser{s: s}
+	p.skipSP()
+	var d Dictionary
+	for p.s != "" {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var m Member
+		if p.peek() == '=' {
+			p.s = p.s[1:]
+			if m, err = p.member(); err != nil {
+				return nil, err
+			}
+		} else {
+			params, err := p.params()
+			if err != nil {
+				return nil, err
+			}
+			m = Item{Value: true, Params: params}
+		}
+		if i := slices.IndexFunc(d, func(dm DictMember) bool { return dm.Key == key }); i >= 0 {
+			d[i].Value = m
+		} else {
+			d = append(d, DictMember{Key: key, Value: m})
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// next moves past the comma between two List or Dictionary members.
+func (p *sfParser) next() error {
+	p.skipOWS()
+	if p.s == "" {
+		return nil
+	}
+	if p.s[0] != ',' {
+		return p.fail("expected comma, got %q", p.s)
+	}
+	p.s = p.s[1:]
+	p.skipOWS()
+	if p.s == "" {
+		return p.fail("trailing comma")
+	}
+	return nil
+}
+
+func (p *sfParser) member() (Member, error) {
+	if p.peek() == '(' {
+		return p.innerList()
+	}
+	return p.item()
+}
+
+// RFC 8941 4.2.1.2
+func (p *sfParser) innerList() (InnerList, error) {
+	p.s = p.s[1:] // (
+	var items []Item
+	for {
+		p.skipSP()
+		if p.s == "" {
+			return InnerList{}, p.fail("unterminated inner list")
+		}
+		if p.s[0] == ')' {
+			p.s = p.s[1:]
+			params, err := p.params()
+			if err != nil {
+				return InnerList{}, err
+			}
+			return InnerList{Items: items, Params: params}, nil
+		}
+		item, err := p.item()
+		if err != nil {
+			return InnerList{}, err
+		}
+		items = append(items, item)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return InnerList{}, p.fail("expected space or ) in inner list, got %q", p.s)
+		}
+	}
+}
+
+// RFC 8941 4.2.3
+func (p *sfParser) item() (Item, error) {
+	v, err := p.bareItem()
+	if err != nil {
+		return Item{}, err
+	}
+	params, err := p.params()
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{Value: v, Params: params}, nil
+}
+
+// RFC 8941 4.2.3.2
+func (p *sfParser) params() (Params, error) {
+	var params Params
+	for p.peek() == ';' {
+		p.s = p.s[1:]
+		p.skipSP()
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var v any = true
+		if p.peek() == '=' {
+			p.s = p.s[1:]
+			if v, err = p.bareItem(); err != nil {
+				return nil, err
+			}
+		}
+		if i := slices.IndexFunc(params, func(pm Param) bool { return pm.Key == key }); i >= 0 {
+			params[i].Value = v
+		} else {
+			params = append(params, Param{Key: key, Value: v})
+		}
+	}
+	return params, nil
+}
+
+// RFC 8941 4.2.3.3
+func (p *sfParser) key() (string, error) {
+	if c := p.peek(); !isLCAlpha(c) && c != '*' {
+		return "", p.fail("invalid key %q", p.s)
+	}
+	i := 1
+	for i < len(p.s) && isKeyChar(p.s[i]) {
+		i++
+	}
+	key := p.s[:i]
+	p.s = p.s[i:]
+	return key, nil
+}
+
+// RFC 8941 4.2.3.1
+func (p *sfParser) bareItem() (any, error) {
+	c := p.peek()
+	switch {
+	case c == '-' || isDigit(c):
+		return p.number()
+	case c == '"':
+		return p.string()
+	case c == '*' || isAlpha(c):
+		return p.token(), nil
+	case c == ':':
+		return p.byteSequence()
+	case c == '?':
+		return p.boolean()
+	default:
+		return nil, p.fail("invalid bare item %q", p.s)
+	}
+}
+
+// RFC 8941 4.2.4
+func (p *sfParser) number() (any, error) {
+	i := 0
+	if p.s[0] == '-' {
+		i++
+	}
+	if i == len(p.s) || !isDigit(p.s[i]) {
+		return nil, p.fail("invalid number %q", p.s)
+	}
+	start, dot := i, -1
+	for ; i < len(p.s); i++ {
+		c := p.s[i]
+		if isDigit(c) {
+			continue
+		}
+		if c == '.' && dot == -1 {
+			if i-start > 12 {
+				return nil, p.fail("decimal with more than 12 integer digits")
+			}
+			dot = i
+			continue
+		}
+		break
+	}
+	num := p.s[:i]
+	if dot == -1 {
+		if i-start > 15 {
+			return nil, p.fail("integer with more than 15 digits")
+		}
+		p.s = p.s[i:]
+		n, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, p.fail("invalid integer %q", num)
+		}
+		return n, nil
+	}
+	if frac := i - dot - 1; frac < 1 || frac > 3 {
+		return nil, p.fail("decimal needs 1 to 3 fractional digits: %q", num)
+	}
+	p.s = p.s[i:]
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return nil, p.fail("invalid decimal %q", num)
+	}
+	return f, nil
+}
+
+// RFC 8941 4.2.5
+func (p *sfParser) string() (string, error) {
+	var b strings.Builder
+	for i := 1; i < len(p.s); i++ {
+		c := p.s[i]
+		switch {
+		case c == '\\':
+			i++
+			if i == len(p.s) || p.s[i] != '"' && p.s[i] != '\\' {
+				return "", p.fail("invalid escape in string")
+			}
+			b.WriteByte(p.s[i])
+		case c == '"':
+			p.s = p.s[i+1:]
+			return b.String(), nil
+		case c < ' ' || c > '~':
+			return "", p.fail("invalid character %q in string", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.fail("unterminated string")
+}
+
+// RFC 8941 4.2.6
+func (p *sfParser) token() Token {
+	i := 1
+	for i < len(p.s) && isTokenChar(p.s[i]) {
+		i++
+	}
+	t := Token(p.s[:i])
+	p.s = p.s[i:]
+	return t
+}
+
+// RFC 8941 4.2.7
+func (p *sfParser) byteSequence() ([]byte, error) {
+	end := strings.IndexByte(p.s[1:], ':')
+	if end == -1 {
+		return nil, p.fail("unterminated byte sequence")
+	}
+	enc := p.s[1 : end+1]
+	if strings.Trim(enc, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/=") != "" {
+		return nil, p.fail("invalid base64 in byte sequence")
+	}
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, p.fail("invalid base64 in byte sequence")
+	}
+	p.s = p.s[end+2:]
+	return b, nil
+}
+
+// RFC 8941 4.2.8
+func (p *sfParser) boolean() (bool, error) {
+	if len(p.s) < 2 || p.s[1] != '0' && p.s[1] != '1' {
+		return false, p.fail("invalid boolean %q", p.s)
+	}
+	v := p.s[1] == '1'
+	p.s = p.s[2:]
+	return v, nil
+}
+
+// SerializeItem serializes item as a field value. RFC 8941 4.1.3
+func SerializeItem(item Item) (string, error) {
+	var b strings.Builder
+	if err := writeItem(&b, item); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// SerializeList serializes l as a field value. An empty List serializes to "". RFC 8941 4.1.1
+func SerializeList(l List) (string, error) {
+	var b strings.Builder
+	for i, m := range l {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := writeMember(&b, m); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// SerializeDictionary serializes d as a field value. An empty Dictionary serializes to "".
+// RFC 8941 4.1.2
+func SerializeDictionary(d Dictionary) (string, error) {
+	var b strings.Builder
+	for i, dm := range d {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := writeKey(&b, dm.Key); err != nil {
+			return "", err
+		}
+		if item, ok := dm.Value.(Item); ok && item.Value == true {
+			if err := writeParams(&b, item.Params); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte('=')
+		if err := writeMember(&b, dm.Value); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+func serializeFail(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidStructuredField, fmt.Sprintf(format, args...))
+}
+
+func writeMember(b *strings.Builder, m Member) error {
+	switch m := m.(type) {
+	case Item:
+		return writeItem(b, m)
+	case InnerList:
+		b.WriteByte('(')
+		for i, item := range m.Items {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			if err := writeItem(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(')')
+		return writeParams(b, m.Params)
+	default:
+		return serializeFail("invalid member %T", m)
+	}
+}
+
+func writeItem(b *strings.Builder, item Item) error {
+	if err := writeBareItem(b, item.Value); err != nil {
+		return err
+	}
+	return writeParams(b, item.Params)
+}
+
+// RFC 8941 4.1.1.2
+func writeParams(b *strings.Builder, params Params) error {
+	for _, p := range params {
+		b.WriteByte(';')
+		if err := writeKey(b, p.Key); err != nil {
+			return err
+		}
+		if p.Value == true {
+			continue
+		}
+		b.WriteByte('=')
+		if err := writeBareItem(b, p.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RFC 8941 4.1.1.3
+func writeKey(b *strings.Builder, key string) error {
+	if key == "" || !isLCAlpha(key[0]) && key[0] != '*' {
+		return serializeFail("invalid key %q", key)
+	}
+	for i := 1; i < len(key); i++ {
+		if !isKeyChar(key[i]) {
+			return serializeFail("invalid key %q", key)
+		}
+	}
+	b.WriteString(key)
+	return nil
+}
+
+// RFC 8941 4.1.3.1
+func writeBareItem(b *strings.Builder, v any) error {
+	switch v := v.(type) {
+	case int:
+		return writeInteger(b, int64(v))
+	case int64:
+		return writeInteger(b, v)
+	case float64:
+		return writeDecimal(b, v)
+	case string:
+		return writeString(b, v)
+	case Token:
+		return writeToken(b, v)
+	case []byte:
+		b.WriteByte(':')
+		b.WriteString(base64.StdEncoding.EncodeToString(v))
+		b.WriteByte(':')
+		return nil
+	case bool:
+		if v {
+			b.WriteString("?1")
+		} else {
+			b.WriteString("?0")
+		}
+		return nil
+	default:
+		return serializeFail("invalid bare item %T", v)
+	}
+}
+
+// RFC 8941 4.1.4
+func writeInteger(b *strings.Builder, n int64) error {
+	if n < -999_999_999_999_999 || n > 999_999_999_999_999 {
+		return serializeFail("integer %d out of range", n)
+	}
+	b.WriteString(strconv.FormatInt(n, 10))
+	return nil
+}
+
+// RFC 8941 4.1.5
+func writeDecimal(b *strings.Builder, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return serializeFail("decimal %v out of range", f)
+	}
+	// round the shortest decimal form, not the binary value, so 0.0015 rounds to 0.002
+	s := strconv.FormatFloat(math.Abs(f), 'f', -1, 64)
+	intPart, frac, _ := strings.Cut(s, ".")
+	if len(frac) > 3 {
+		digits := []byte(intPart + frac[:3])
+		rest := frac[3:]
+		last := digits[len(digits)-1] - '0'
+		if rest[0] > '5' || rest[0] == '5' && (strings.Trim(rest[1:], "0") != "" || last%2 == 1) {
+			digits = roundUp(digits)
+		}
+		intPart, frac = string(digits[:len(digits)-3]), string(digits[len(digits)-3:])
+	}
+	frac = strings.TrimRight(frac, "0")
+	if frac == "" {
+		frac = "0"
+	}
+	if len(intPart) > 12 {
+		return serializeFail("decimal %v out of range", f)
+	}
+	if f < 0 && (intPart != "0" || frac != "0") {
+		b.WriteByte('-')
+	}
+	b.WriteString(intPart + "." + frac)
+	return nil
+}
+
+// roundUp adds one to the last digit of a decimal digit string.
+func roundUp(digits []byte) []byte {
+	for i := len(digits) - 1; i >= 0; i-- {
+		if digits[i] != '9' {
+			digits[i]++
+			return digits
+		}
+		digits[i] = '0'
+	}
+	return append([]byte{'1'}, digits...)
+}
+
+// RFC 8941 4.1.6
+func writeString(b *strings.Builder, s string) error {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' {
+			return serializeFail("invalid character %q in string", c)
+		}
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return nil
+}
+
+// RFC 8941 4.1.7
+func writeToken(b *strings.Builder, t Token) error {
+	if t == "" || !isAlpha(t[0]) && t[0] != '*' {
+		return serializeFail("invalid token %q", t)
+	}
+	for i := 1; i < len(t); i++ {
+		if !isTokenChar(t[i]) {
+			return serializeFail("invalid token %q", t)
+		}
+	}
+	b.WriteString(string(t))
+	return nil
+}
+
+func isDigit(c byte) bool   { return c >= '0' && c <= '9' }
+func isLCAlpha(c byte) bool { return c >= 'a' && c <= 'z' }
+func isAlpha(c byte) bool   { return isLCAlpha(c) || c >= 'A' && c <= 'Z' }
+
+func isKeyChar(c byte) bool {
+	return isLCAlpha(c) || isDigit(c) || c == '_' || c == '-' || c == '.' || c == '*'
+}
+
+// isTokenChar reports whether c may follow the first character of an sf-token:
+// a tchar, ":" or "/".
+func isTokenChar(c byte) bool {
+	return validTokens([]byte{c}) || c == ':' || c == '/'
+}
@@ -0,0 +1,286 @@
+package headers
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sfTest is a single case in the structured-field-tests JSON format.
+type sfTest struct {
+	Name       string          `json:"name"`
+	Raw        []string        `json:"raw"`
+	HeaderType string          `json:"header_type"`
+	Expected   json.RawMessage `json:"expected"`
+	MustFail   bool            `json:"must_fail"`
+	CanFail    bool            `json:"can_fail"`
+	Canonical  []string        `json:"canonical"`
+}
+
+// sfTestDir holds the structured-field-tests vectors.
+var sfTestDir = filepath.Join("testdata", "structured-field-tests")
+
+// sfSkip lists the vectors that are not run, by file or by file/name, with
+// the reason. Every vector in testdata passes, so it is empty.
+var sfSkip = map[string]string{}
+
+func loadSFTests(t *testing.T, pattern string) map[string][]sfTest {
+	files, err := filepath.Glob(filepath.Join(sfTestDir, pattern))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	suites := make(map[string][]sfTest)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		var tests []sfTest
+		require.NoError(t, json.Unmarshal(data, &tests), file)
+		name, err := filepath.Rel(sfTestDir, file)
+		require.NoError(t, err)
+		suites[filepath.ToSlash(name)] = tests
+	}
+	return suites
+}
+
+// skipSF skips the test if sfSkip lists its file or case.
+func skipSF(t *testing.T, file string, tc sfTest) {
+	t.Helper()
+	for _, key := range []string{file, file + "/" + tc.Name} {
+		if reason, ok := sfSkip[key]; ok {
+			t.Skip(reason)
+		}
+	}
+}
+
+func TestStructuredFieldParse(t *testing.T) {
+	for file, tests := range loadSFTests(t, "*.json") {
+		for _, tc := range tests {
+			t.Run(file+"/"+tc.Name, func(t *testing.T) {
+				skipSF(t, file, tc)
+				h := NewHeaders()
+				for _, raw := range tc.Raw {
+					h.Add("Example", raw)
+				}
+
+				var got any
+				var err error
+				switch tc.HeaderType {
+				case "item":
+					got, err = h.Item("example")
+				case "list":
+					got, err = h.List("example")
+				case "dictionary":
+					got, err = h.Dictionary("example")
+				default:
+					t.Fatalf("unknown header_type %q", tc.HeaderType)
+				}
+
+				if tc.MustFail {
+					require.ErrorIs(t, err, ErrInvalidStructuredField)
+					return
+				}
+				if tc.CanFail && err != nil {
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, decodeSF(t, tc.HeaderType, tc.Expected), got)
+
+				canonical := strings.Join(tc.Raw, ", ")
+				if tc.Canonical != nil {
+					canonical = strings.Join(tc.Canonical, ", ")
+				}
+				ser, err := serializeSF(got)
+				require.NoError(t, err)
+				assert.Equal(t, canonical, ser)
+			})
+		}
+	}
+}
+
+func TestStructuredFieldSerialize(t *testing.T) {
+	for file, tests := range loadSFTests(t, "serialisation-tests/*.json") {
+		for _, tc := range tests {
+			t.Run(file+"/"+tc.Name, func(t *testing.T) {
+				skipSF(t, file, tc)
+				ser, err := serializeSF(decodeSF(t, tc.HeaderType, tc.Expected))
+				if tc.MustFail {
+					require.ErrorIs(t, err, ErrInvalidStructuredField)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, strings.Join(tc.Canonical, ", "), ser)
+			})
+		}
+	}
+}
+
+func TestStructuredFieldAccessors(t *testing.T) {
+	// Test: Priority dictionary
+	h := NewHeaders()
+	h.Add("Priority", "u=3")
+	h.Add("Priority", "i")
+	d, err := h.Dictionary("priority")
+	require.NoError(t, err)
+	u, ok := d.Get("u")
+	require.True(t, ok)
+	assert.Equal(t, Item{Value: int64(3)}, u)
+	i, ok := d.Get("i")
+	require.True(t, ok)
+	assert.Equal(t, Item{Value: true}, i)
+
+	// Test: Missing list and dictionary fields are empty
+	l, err := h.List("cache-status")
+	require.NoError(t, err)
+	assert.Empty(t, l)
+	d, err = h.Dictionary("signature-input")
+	require.NoError(t, err)
+	assert.Empty(t, d)
+
+	// Test: Missing item field
+	_, err = h.Item("x-item")
+	require.ErrorIs(t, err, ErrInvalidStructuredField)
+
+	// Test: Cache-Status list with parameters
+	h.Add("Cache-Status", `ExampleCache; hit; ttl=376, "origin"; fwd=uri-miss`)
+	l, err = h.List("cache-status")
+	require.NoError(t, err)
+	require.Len(t, l, 2)
+	first := l[0].(Item)
+	assert.Equal(t, Token("ExampleCache"), first.Value)
+	ttl, ok := first.Params.Get("ttl")
+	require.True(t, ok)
+	assert.Equal(t, int64(376), ttl)
+	fwd, ok := l[1].(Item).Params.Get("fwd")
+	require.True(t, ok)
+	assert.Equal(t, Token("uri-miss"), fwd)
+
+	// Test: Set a Content-Digest dictionary
+	err = h.SetDictionary("Content-Digest", Dictionary{
+		{Key: "sha-256", Value: Item{Value: []byte("hello")}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sha-256=:aGVsbG8=:"}, h.Values("content-digest"))
+
+	// Test: Set a Signature-Input inner list
+	err = h.SetDictionary("Signature-Input", Dictionary{{
+		Key: "sig1",
+		Value: InnerList{
+			Items:  []Item{{Value: "@method"}, {Value: "@authority"}},
+			Params: Params{{Key: "created", Value: 1618884473}, {Key: "keyid", Value: "test-key"}},
+		},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{`sig1=("@method" "@authority");created=1618884473;keyid="test-key"`}, h.Values("signature-input"))
+
+	// Test: Set an invalid item leaves the field alone
+	h.Set("X-Item", "1")
+	err = h.SetItem("X-Item", Item{Value: Token("not a token")})
+	require.ErrorIs(t, err, ErrInvalidStructuredField)
+	assert.Equal(t, []string{"1"}, h.Values("x-item"))
+
+	// Test: Set an empty list removes the field
+	require.NoError(t, h.SetList("Cache-Status", nil))
+	assert.Empty(t, h.Values("cache-status"))
+}
+
+func serializeSF(v any) (string, error) {
+	switch v := v.(type) {
+	case Item:
+		return SerializeItem(v)
+	case List:
+		return SerializeList(v)
+	case Dictionary:
+		return SerializeDictionary(v)
+	}
+	panic("unreachable")
+}
+
+// decodeSF converts an "expected" value from the JSON test format into the headers types.
+func decodeSF(t *testing.T, headerType string, raw json.RawMessage) any {
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.UseNumber()
+	var v any
+	require.NoError(t, dec.Decode(&v))
+
+	switch headerType {
+	case "item":
+		return decodeSFItem(t, v)
+	case "list":
+		var l List
+		for _, m := range v.([]any) {
+			l = append(l, decodeSFMember(t, m))
+		}
+		return l
+	case "dictionary":
+		var d Dictionary
+		for _, m := range v.([]any) {
+			pair := m.([]any)
+			d = append(d, DictMember{Key: pair[0].(string), Value: decodeSFMember(t, pair[1])})
+		}
+		return d
+	}
+	t.Fatalf("unknown header_type %q", headerType)
+	return nil
+}
+
+func decodeSFMember(t *testing.T, v any) Member {
+	pair := v.([]any)
+	items, ok := pair[0].([]any)
+	if !ok {
+		return decodeSFItem(t, v)
+	}
+	var il InnerList
+	for _, item := range items {
+		il.Items = append(il.Items, decodeSFItem(t, item))
+	}
+	il.Params = decodeSFParams(t, pair[1])
+	return il
+}
+
+func decodeSFItem(t *testing.T, v any) Item {
+	pair := v.([]any)
+	return Item{Value: decodeSFBareItem(t, pair[0]), Params: decodeSFParams(t, pair[1])}
+}
+
+func decodeSFParams(t *testing.T, v any) Params {
+	var params Params
+	for _, p := range v.([]any) {
+		pair := p.([]any)
+		params = append(params, Param{Key: pair[0].(string), Value: decodeSFBareItem(t, pair[1])})
+	}
+	return params
+}
+
+func decodeSFBareItem(t *testing.T, v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			f, err := v.Float64()
+			require.NoError(t, err)
+			return f
+		}
+		n, err := v.Int64()
+		require.NoError(t, err)
+		return n
+	case string, bool:
+		return v
+	case map[string]any:
+		val := v["value"].(string)
+		switch v["__type"] {
+		case "token":
+			return Token(val)
+		case "binary":
+			b, err := base32.StdEncoding.DecodeString(val)
+			require.NoError(t, err)
+			return b
+		}
+	}
+	t.Fatalf("unknown bare item %v", v)
+	return nil
+}
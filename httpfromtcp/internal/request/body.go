@@ -0,0 +1,142 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrBodyReadAfterClose is returned when reading a Body after it was closed.
+var ErrBodyReadAfterClose = errors.New("read on closed request body")
+
+// NoBody is the Body of a request that carries no message body.
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// body is the Body of a request that has a message body. It wraps the
+// reader that undoes the message framing.
+type body struct {
+	src    io.Reader
+	closed bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	return b.src.Read(p)
+}
+
+// Close stops the handler from reading the body. Whatever is left of it
+// is discarded before the next request on the connection is parsed.
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+// discard reads the rest of the body, even after Close. A negative limit
+// means no limit, otherwise a body with more than limit bytes left fails
+// with ErrUnreadBody.
+func (b *body) discard(limit int64) error {
+	if limit < 0 {
+		_, err := io.Copy(io.Discard, b.src)
+		return err
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(b.src, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("%w: more than %d bytes left", ErrUnreadBody, limit)
+	}
+	return nil
+}
+
+// contentLengthReader reads a body framed by the Content-Length header.
+type contentLengthReader struct {
+	buf       *buffer
+	remaining int64
+}
+
+func (r *contentLengthReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.buf.read(p)
+	r.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// closeDelimitedReader reads a body that ends when the connection does.
+type closeDelimitedReader struct {
+	buf *buffer
+}
+
+func (r *closeDelimitedReader) Read(p []byte) (int, error) {
+	return r.buf.read(p)
+}
+
+// MaxBytesError is returned by a body wrapped with MaxBytesReader
+// once more than Limit bytes have been read from it.
+type MaxBytesError struct {
+	Limit int64
+}
+
+func (e *MaxBytesError) Error() string {
+	return fmt.Sprintf("request body too large, limit is %d bytes", e.Limit)
+}
+
+// MaxBytesReader limits the number of bytes that can be read from body to n.
+// Reading past the limit fails with a *MaxBytesError.
+func MaxBytesReader(body io.ReadCloser, n int64) io.ReadCloser {
+	return &maxBytesReader{body: body, remaining: n, limit: n}
+}
+
+type maxBytesReader struct {
+	body      io.ReadCloser
+	remaining int64
+	limit     int64
+	err       error
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// read one byte more than allowed to tell a body that ends exactly
+	// at the limit apart from one that goes over it
+	if int64(len(p))-1 > r.remaining {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.body.Read(p)
+
+	if int64(n) <= r.remaining {
+		r.remaining -= int64(n)
+		r.err = err
+		return n, err
+	}
+
+	n = int(r.remaining)
+	r.remaining = 0
+	r.err = &MaxBytesError{Limit: r.limit}
+	return n, r.err
+}
+
+func (r *maxBytesReader) Close() error {
+	return r.body.Close()
+}
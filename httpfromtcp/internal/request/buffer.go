@@ -0,0 +1,73 @@
+package request
+
+import "io"
+
+// buffer holds the bytes read from a connection that have not been consumed
+// by the parser yet. The body readers share it with the request parser, so
+// whatever was read past the end of the headers is not lost.
+type buffer struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	err         error
+}
+
+func newBuffer(reader io.Reader) *buffer {
+	return &buffer{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// data returns the buffered, unconsumed bytes.
+func (b *buffer) data() []byte {
+	return b.buf[:b.readToIndex]
+}
+
+// consume drops the first n buffered bytes.
+func (b *buffer) consume(n int) {
+	copy(b.buf, b.buf[n:b.readToIndex])
+	b.readToIndex -= n
+}
+
+// fill reads more data from the underlying reader, growing the buffer if it is full.
+// An error returned alongside data is held back until the next call.
+func (b *buffer) fill() error {
+	if b.err != nil {
+		return b.err
+	}
+
+	if b.readToIndex >= len(b.buf) {
+		newBuf := make([]byte, len(b.buf)*2)
+		copy(newBuf, b.buf)
+		b.buf = newBuf
+	}
+
+	n, err := b.reader.Read(b.buf[b.readToIndex:])
+	b.readToIndex += n
+	if err != nil {
+		b.err = err
+		if n > 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+// read copies buffered bytes into p, or reads straight from the underlying
+// reader when nothing is buffered so large bodies skip the extra copy.
+func (b *buffer) read(p []byte) (int, error) {
+	if b.readToIndex > 0 {
+		n := copy(p, b.data())
+		b.consume(n)
+		return n, nil
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.reader.Read(p)
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,257 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+)
+
+// maxChunkLineBytes caps a chunk-size line, extensions included, and each
+// trailer field line, so a line that never ends cannot fill memory.
+const maxChunkLineBytes = 4 << 10
+
+type chunkState int
+
+const (
+	chunkStateSize chunkState = iota
+	chunkStateData
+	chunkStateDataEnd
+	chunkStateTrailers
+	chunkStateDone
+)
+
+// chunkedReader decodes a body sent with the chunked transfer coding.
+// Trailer fields are added to trailers once the last chunk has been read.
+// RFC 9112 7.1
+type chunkedReader struct {
+	buf       *buffer
+	trailers  *headers.Headers
+	limits    Limits
+	obsFold   headers.ObsFold
+	state     chunkState
+	remaining int64
+
+	trailerBytes int
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for {
+		switch cr.state {
+		case chunkStateDone:
+			return 0, io.EOF
+		case chunkStateData:
+			if len(p) == 0 {
+				return 0, nil
+			}
+			if int64(len(p)) > cr.remaining {
+				p = p[:cr.remaining]
+			}
+			n, err := cr.buf.read(p)
+			cr.remaining -= int64(n)
+			if cr.remaining == 0 {
+				cr.state = chunkStateDataEnd
+			}
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		default:
+			n, err := cr.parseSingle(cr.buf.data())
+			if err != nil {
+				return 0, err
+			}
+			if n > 0 {
+				cr.buf.consume(n)
+				continue
+			}
+			if err := cr.buf.fill(); err != nil {
+				if errors.Is(err, io.EOF) {
+					return 0, io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		}
+	}
+}
+
+// parseSingle parses the framing around the chunk data: chunk-size lines,
+// the CRLF after each chunk and the trailer section.
+func (cr *chunkedReader) parseSingle(data []byte) (int, error) {
+	switch cr.state {
+	case chunkStateSize:
+		size, n, err := parseChunkSize(data)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		if size == 0 { // last-chunk, only the trailer section is left
+			cr.state = chunkStateTrailers
+		} else {
+			cr.remaining = size
+			cr.state = chunkStateData
+		}
+		return n, nil
+	case chunkStateDataEnd:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, fmt.Errorf("%w: chunk data not terminated by CRLF", ErrMalformedChunk)
+		}
+		cr.state = chunkStateSize
+		return len(crlf), nil
+	case chunkStateTrailers:
+		opts, err := cr.limits.headerOptions(cr.trailerBytes, cr.obsFold)
+		if err != nil {
+			return 0, err
+		}
+		opts.MaxBytes = min(opts.MaxBytes, maxChunkLineBytes)
+		n, done, err := cr.trailers.ParseWithOptions(data, opts)
+		if err != nil {
+			return 0, err
+		}
+		cr.trailerBytes += n
+		if done {
+			cr.state = chunkStateDone
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("unknown chunkState")
+	}
+}
+
+// parseChunkSize parses a chunk-size line, including any chunk extensions.
+// It returns the chunk size and the number of bytes consumed, or 0 consumed
+// bytes if the line is not complete yet. A line longer than maxChunkLineBytes
+// fails with ErrLineTooLong.
+//
+//	chunk      = chunk-size [ chunk-ext ] CRLF
+//	chunk-ext  = *( BWS ";" BWS chunk-ext-name [ BWS "=" BWS chunk-ext-val ] )
+func parseChunkSize(data []byte) (int64, int, error) {
+	idx := bytes.Index(data, []byte(crlf))
+	if idx > maxChunkLineBytes || idx == -1 && len(data) > maxChunkLineBytes {
+		return 0, 0, fmt.Errorf("%w: chunk-size line longer than %d bytes", ErrLineTooLong, maxChunkLineBytes)
+	}
+	if idx == -1 {
+		return 0, 0, nil
+	}
+
+	line := string(data[:idx])
+	sizeStr, ext, hasExt := strings.Cut(line, ";")
+	if hasExt { // BWS is only allowed before the ';' of an extension
+		sizeStr = strings.TrimRight(sizeStr, " \t")
+	}
+	if sizeStr == "" {
+		return 0, 0, fmt.Errorf("%w: missing chunk size: %q", ErrMalformedChunk, line)
+	}
+	for _, c := range sizeStr {
+		if !isHexDigit(c) {
+			return 0, 0, fmt.Errorf("%w: invalid chunk size: %q", ErrMalformedChunk, sizeStr)
+		}
+	}
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid chunk size: %q", ErrMalformedChunk, sizeStr)
+	}
+
+	if hasExt {
+		if err := validChunkExtensions(ext); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return size, idx + 2, nil
+}
+
+// validChunkExtensions checks the syntax of the chunk extensions following the
+// first ';' of a chunk-size line. Extensions carry no meaning for us, so they are
+// only validated and then ignored.
+//
+//	chunk-ext-val  = token / quoted-string
+//	quoted-string  = DQUOTE *( qdtext / quoted-pair ) DQUOTE
+func validChunkExtensions(ext string) error {
+	rest := ext
+	for {
+		rest = trimBWS(rest)
+		n := tokenLen(rest)
+		if n == 0 {
+			return fmt.Errorf("%w: invalid extension name: %q", ErrMalformedChunk, ext)
+		}
+		rest = trimBWS(rest[n:])
+		if strings.HasPrefix(rest, "=") {
+			rest = trimBWS(rest[1:])
+			n = tokenLen(rest)
+			if n == 0 {
+				n = quotedStringLen(rest)
+			}
+			if n == 0 {
+				return fmt.Errorf("%w: invalid extension value: %q", ErrMalformedChunk, ext)
+			}
+			rest = trimBWS(rest[n:])
+		}
+		if rest == "" {
+			return nil
+		}
+		if rest[0] != ';' {
+			return fmt.Errorf("%w: invalid extension: %q", ErrMalformedChunk, ext)
+		}
+		rest = rest[1:]
+	}
+}
+
+// trimBWS removes the optional whitespace at the start of s. RFC 9110 5.6.3
+func trimBWS(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
+
+// tokenLen returns the length of the token at the start of s, 0 if none.
+func tokenLen(s string) int {
+	n := 0
+	for n < len(s) && headers.IsToken(s[n:n+1]) {
+		n++
+	}
+	return n
+}
+
+// quotedStringLen returns the length of the quoted string at the start of s,
+// or 0 if s does not start with a well-formed one. RFC 9110 5.6.4
+func quotedStringLen(s string) int {
+	if !strings.HasPrefix(s, `"`) {
+		return 0
+	}
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return i + 1
+		case c == '\\': // quoted-pair
+			i++
+			if i == len(s) || !isQuotedPairChar(s[i]) {
+				return 0
+			}
+		case !isQdtext(c):
+			return 0
+		}
+	}
+	return 0
+}
+
+// isQdtext reports whether c may appear unescaped in a quoted string.
+func isQdtext(c byte) bool {
+	return c == '\t' || c == ' ' || c == 0x21 || c >= 0x23 && c <= 0x5b || c >= 0x5d && c <= 0x7e || c >= 0x80
+}
+
+// isQuotedPairChar reports whether c may follow a backslash in a quoted string.
+func isQuotedPairChar(c byte) bool {
+	return c == '\t' || c >= ' ' && c != 0x7f
+}
+
+func isHexDigit(c rune) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
@@ -0,0 +1,34 @@
+package request
+
+import "errors"
+
+var (
+	// ErrMalformedRequestLine is returned for a request-line that does not
+	// follow the "method SP request-target SP HTTP-version" grammar.
+	ErrMalformedRequestLine = errors.New("malformed request-line")
+	// ErrInvalidTarget is returned for a request-target that is not
+	// in the form its method requires.
+	ErrInvalidTarget = errors.New("invalid request-target")
+	// ErrURITooLong is returned when the request-line is longer than allowed.
+	ErrURITooLong = errors.New("request-target too long")
+	// ErrUnsupportedVersion is returned for a well-formed HTTP-version
+	// that this server does not speak.
+	ErrUnsupportedVersion = errors.New("unsupported HTTP-version")
+	// ErrBadContentLength is returned for an invalid Content-Length header,
+	// including repeated Content-Length fields that disagree.
+	ErrBadContentLength = errors.New("invalid Content-Length")
+	// ErrAmbiguousFraming is returned when the headers do not pin down a single
+	// way to find the end of the body, e.g. both Content-Length and Transfer-Encoding.
+	ErrAmbiguousFraming = errors.New("ambiguous message framing")
+	// ErrUnsupportedTransferCoding is returned for a transfer coding other than chunked.
+	ErrUnsupportedTransferCoding = errors.New("unsupported transfer coding")
+	// ErrUnreadBody is returned by Parser.Next when the previous request left
+	// too much of its body unread to be discarded.
+	ErrUnreadBody = errors.New("too much of the previous body left unread")
+	// ErrMalformedChunk is returned when reading a chunked body whose framing
+	// breaks the chunked coding: a bad chunk-size line or a missing CRLF.
+	ErrMalformedChunk = errors.New("malformed chunk")
+	// ErrLineTooLong is returned by MessageReader.ReadLine for a line longer than
+	// allowed, and when reading a chunked body with an overly long chunk-size line.
+	ErrLineTooLong = errors.New("line too long")
+)
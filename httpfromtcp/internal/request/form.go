@@ -0,0 +1,191 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+const (
+	// DefaultMaxFormBytes caps how much of an application/x-www-form-urlencoded
+	// body ParseForm reads into memory.
+	DefaultMaxFormBytes = 10 << 20
+	// DefaultMaxMemory is the maxMemory used when FormValue, PostFormValue or
+	// FormFile parse the multipart form on their own.
+	DefaultMaxMemory = 32 << 20
+)
+
+var (
+	// ErrNotMultipart is returned when a multipart method is used on a request
+	// that is not multipart/form-data.
+	ErrNotMultipart = errors.New("request Content-Type is not multipart/form-data")
+	// ErrMissingBoundary is returned for a multipart/form-data request without a boundary parameter.
+	ErrMissingBoundary = errors.New("no multipart boundary param in Content-Type")
+	// ErrMultipartRead is returned when the body was already claimed by MultipartReader
+	// or ParseMultipartForm.
+	ErrMultipartRead = errors.New("multipart body already read")
+	// ErrFormTooLarge is returned by ParseForm for an urlencoded body over DefaultMaxFormBytes.
+	ErrFormTooLarge = errors.New("urlencoded form too large")
+)
+
+// ParseForm populates Form with the query parameters and, for an
+// application/x-www-form-urlencoded body, PostForm and Form with the body fields.
+// Body fields come before query values in Form. It is a no-op when called again.
+func (r *Request) ParseForm() error {
+	if r.PostForm == nil {
+		r.PostForm = make(url.Values)
+		if err := r.parsePostForm(); err != nil {
+			return err
+		}
+	}
+
+	if r.Form == nil {
+		r.Form = make(url.Values)
+		for k, v := range r.PostForm {
+			r.Form[k] = append(r.Form[k], v...)
+		}
+		query, err := url.ParseQuery(r.RawQuery())
+		for k, v := range query {
+			r.Form[k] = append(r.Form[k], v...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Request) parsePostForm() error {
+	switch r.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+	default:
+		return nil
+	}
+
+	contentType, _ := r.Headers.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, DefaultMaxFormBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > DefaultMaxFormBytes {
+		return ErrFormTooLarge
+	}
+
+	values, err := url.ParseQuery(string(data))
+	for k, v := range values {
+		r.PostForm[k] = append(r.PostForm[k], v...)
+	}
+	return err
+}
+
+// MultipartReader returns a reader over the parts of a multipart/form-data body,
+// so files can be streamed one part at a time. Use it instead of ParseMultipartForm.
+func (r *Request) MultipartReader() (*multipart.Reader, error) {
+	if r.MultipartForm != nil || r.multipartRead {
+		return nil, ErrMultipartRead
+	}
+	r.multipartRead = true
+	return r.multipartReader()
+}
+
+func (r *Request) multipartReader() (*multipart.Reader, error) {
+	contentType, _ := r.Headers.Get("Content-Type")
+	if contentType == "" {
+		return nil, ErrNotMultipart
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+	boundary, ok := params["boundary"]
+	if !ok || boundary == "" {
+		return nil, ErrMissingBoundary
+	}
+	return multipart.NewReader(r.Body, boundary), nil
+}
+
+// ParseMultipartForm parses a multipart/form-data body into MultipartForm.
+// Up to maxMemory bytes of file parts are kept in memory, the rest spill to
+// temporary files on disk. Non-file fields are also added to Form and PostForm.
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if r.multipartRead {
+		return ErrMultipartRead
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	mr, err := r.multipartReader()
+	if err != nil {
+		return err
+	}
+	r.multipartRead = true
+
+	form, err := mr.ReadForm(maxMemory)
+	if err != nil {
+		return fmt.Errorf("reading multipart form: %w", err)
+	}
+	r.MultipartForm = form
+
+	for k, v := range form.Value {
+		r.Form[k] = append(r.Form[k], v...)
+		r.PostForm[k] = append(r.PostForm[k], v...)
+	}
+	return nil
+}
+
+// FormValue returns the first value for key from the body fields or the query,
+// parsing the form first if needed. Parse errors are ignored.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		r.ParseMultipartForm(DefaultMaxMemory)
+	}
+	return r.Form.Get(key)
+}
+
+// PostFormValue is like FormValue, but ignores the query.
+func (r *Request) PostFormValue(key string) string {
+	if r.PostForm == nil {
+		r.ParseMultipartForm(DefaultMaxMemory)
+	}
+	return r.PostForm.Get(key)
+}
+
+// FormFile returns the first file uploaded under key,
+// parsing the multipart form first if needed.
+func (r *Request) FormFile(key string) (multipart.File, *multipart.FileHeader, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(DefaultMaxMemory); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	files := r.MultipartForm.File[key]
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no file uploaded for %q", key)
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, files[0], nil
+}
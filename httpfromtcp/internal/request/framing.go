@@ -0,0 +1,93 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+)
+
+// bodyFraming works out how the end of the request body is found. It follows
+// the strict reading of RFC 9112 6.1 and 6.3: anything a proxy in front of us
+// could frame differently is rejected rather than guessed at, since that
+// disagreement is what request smuggling relies on.
+// contentLength is -1 for a chunked body. HTTP/1.0 has no transfer codings,
+// so Transfer-Encoding in an HTTP/1.0 request is rejected as well.
+func bodyFraming(h *headers.Headers, http11 bool) (chunked bool, contentLength int64, err error) {
+	te, hasTE := h.Get("Transfer-Encoding")
+	cl, hasCL := h.Get("Content-Length")
+
+	if hasTE && hasCL {
+		return false, 0, fmt.Errorf("%w: both Transfer-Encoding and Content-Length are present", ErrAmbiguousFraming)
+	}
+
+	if hasTE {
+		if !http11 {
+			return false, 0, fmt.Errorf("%w: Transfer-Encoding in an HTTP/1.0 request", ErrAmbiguousFraming)
+		}
+		if err := validTransferEncoding(te); err != nil {
+			return false, 0, err
+		}
+		return true, -1, nil
+	}
+
+	if hasCL {
+		contentLength, err := ParseContentLength(cl)
+		if err != nil {
+			return false, 0, err
+		}
+		return false, contentLength, nil
+	}
+
+	// assume if no content-length header is present, there is no body
+	return false, 0, nil
+}
+
+// validTransferEncoding checks that chunked is the only transfer coding,
+// applied once. It is the only one we can decode, and without it being
+// last the body length cannot be determined at all.
+func validTransferEncoding(te string) error {
+	codings := strings.Split(te, ",")
+	for i, coding := range codings {
+		coding = strings.Trim(coding, " \t")
+		if !strings.EqualFold(coding, "chunked") {
+			if i == len(codings)-1 {
+				return fmt.Errorf("%w: chunked is not the final transfer coding: %q", ErrAmbiguousFraming, te)
+			}
+			return fmt.Errorf("%w: %q", ErrUnsupportedTransferCoding, coding)
+		}
+		if i != len(codings)-1 {
+			return fmt.Errorf("%w: chunked applied more than once: %q", ErrAmbiguousFraming, te)
+		}
+	}
+	return nil
+}
+
+// ParseContentLength parses a Content-Length value. Repeated Content-Length
+// fields arrive comma-joined; they are accepted only when they all agree.
+// Each value must be plain digits: no sign, no hex and no stray whitespace.
+// It fails with ErrBadContentLength.
+func ParseContentLength(value string) (int64, error) {
+	length := int64(-1)
+	for _, v := range strings.Split(value, ",") {
+		v = strings.Trim(v, " \t")
+		if v == "" {
+			return 0, fmt.Errorf("%w: empty value in %q", ErrBadContentLength, value)
+		}
+		for _, c := range v {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("%w: %q", ErrBadContentLength, value)
+			}
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrBadContentLength, value)
+		}
+		if length != -1 && n != length {
+			return 0, fmt.Errorf("%w: conflicting values %q", ErrBadContentLength, value)
+		}
+		length = n
+	}
+	return length, nil
+}
@@ -0,0 +1,122 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+)
+
+// MessageReader reads the parts of the HTTP messages arriving on one
+// connection: start lines, header sections and bodies. They all share one
+// buffer, so bytes read past the end of one part are kept for the next.
+// Parser does the same for requests; MessageReader is for messages that are
+// not requests, such as the responses read by the response package.
+type MessageReader struct {
+	// Limits applies to header sections and to trailers read after it is set.
+	Limits Limits
+	// ObsFold is how folded header and trailer lines are handled. They are rejected by default.
+	ObsFold headers.ObsFold
+
+	buf  *buffer
+	prev *body
+}
+
+func NewMessageReader(reader io.Reader) *MessageReader {
+	return &MessageReader{buf: newBuffer(reader)}
+}
+
+// ReadLine reads the next line, which is how every message starts, and returns
+// it without its CRLF. Whatever was left unread of the previous body is
+// discarded first. It returns io.EOF if the connection ends before the line
+// begins, and ErrLineTooLong if the line is longer than maxBytes.
+func (m *MessageReader) ReadLine(maxBytes int) (string, error) {
+	if m.prev != nil {
+		if err := m.prev.discard(-1); err != nil {
+			return "", err
+		}
+		m.prev = nil
+	}
+
+	for {
+		data := m.buf.data()
+		if idx := bytes.Index(data, []byte(crlf)); idx != -1 {
+			if idx > maxBytes {
+				return "", fmt.Errorf("%w: %d bytes", ErrLineTooLong, idx)
+			}
+			line := string(data[:idx])
+			m.buf.consume(idx + len(crlf))
+			return line, nil
+		}
+		if len(data) > maxBytes {
+			return "", fmt.Errorf("%w: no CRLF in %d bytes", ErrLineTooLong, len(data))
+		}
+
+		if err := m.buf.fill(); err != nil {
+			if errors.Is(err, io.EOF) && len(data) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	}
+}
+
+// ReadHeaders parses a header section into h, up to and including the empty
+// line that ends it.
+func (m *MessageReader) ReadHeaders(h *headers.Headers) error {
+	limits := m.Limits.withDefaults()
+	used := 0
+	for {
+		opts, err := limits.headerOptions(used, m.ObsFold)
+		if err != nil {
+			return err
+		}
+		n, done, err := h.ParseWithOptions(m.buf.data(), opts)
+		if err != nil {
+			return err
+		}
+		m.buf.consume(n)
+		used += n
+		if done {
+			return nil
+		}
+		if n > 0 {
+			continue
+		}
+
+		if err := m.buf.fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("incomplete header section: %w", io.ErrUnexpectedEOF)
+			}
+			return err
+		}
+	}
+}
+
+// ContentLengthBody returns the body that follows, framed by a Content-Length
+// of n bytes.
+func (m *MessageReader) ContentLengthBody(n int64) io.ReadCloser {
+	if n <= 0 {
+		return NoBody
+	}
+	return m.setBody(&contentLengthReader{buf: m.buf, remaining: n})
+}
+
+// ChunkedBody returns the body that follows, decoding the chunked transfer
+// coding. Trailer fields are added to trailers once it has been read to EOF.
+func (m *MessageReader) ChunkedBody(trailers *headers.Headers) io.ReadCloser {
+	return m.setBody(&chunkedReader{buf: m.buf, trailers: trailers, limits: m.Limits.withDefaults(), obsFold: m.ObsFold})
+}
+
+// CloseDelimitedBody returns the rest of the connection as the body, for a
+// message whose end is only marked by the connection closing. RFC 9112 6.3
+func (m *MessageReader) CloseDelimitedBody() io.ReadCloser {
+	return m.setBody(&closeDelimitedReader{buf: m.buf})
+}
+
+func (m *MessageReader) setBody(src io.Reader) io.ReadCloser {
+	m.prev = &body{src: src}
+	return m.prev
+}
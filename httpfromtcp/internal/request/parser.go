@@ -0,0 +1,61 @@
+package request
+
+import (
+	"io"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+)
+
+// MaxDrainBytes is how much of a body the handler left unread Parser.Next is
+// willing to read and throw away to get to the next request.
+const MaxDrainBytes = 256 << 10
+
+// Parser reads consecutive requests from a single connection. Bytes read
+// past the end of one request are kept for the next one, which makes
+// keep-alive and pipelined requests possible.
+type Parser struct {
+	// Limits applies to every request parsed after it is set.
+	Limits Limits
+	// ObsFold is how folded header and trailer lines are handled. They are rejected by default.
+	ObsFold headers.ObsFold
+	// OnRequestStart, if set, is called by Next as soon as the first byte of a
+	// request has arrived, before the rest of it is read.
+	OnRequestStart func()
+
+	buf  *buffer
+	prev *Request
+}
+
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{buf: newBuffer(reader)}
+}
+
+// Next parses the next request on the connection. Whatever the caller left
+// unread of the previous request's body is discarded first, unless it is more
+// than MaxDrainBytes, in which case Next fails with ErrUnreadBody and the
+// connection is not worth keeping. Next returns io.EOF if the connection is
+// closed before another request begins.
+func (p *Parser) Next() (*Request, error) {
+	if p.prev != nil && p.prev.body != nil {
+		if err := p.prev.body.discard(MaxDrainBytes); err != nil {
+			return nil, err
+		}
+	}
+	p.prev = nil
+
+	if len(p.buf.data()) == 0 {
+		if err := p.buf.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if p.OnRequestStart != nil {
+		p.OnRequestStart()
+	}
+
+	req, err := readRequest(p.buf, p.Limits, p.ObsFold)
+	if err != nil {
+		return nil, err
+	}
+	p.prev = req
+	return req, nil
+}
@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"mime/multipart"
+	"net/url"
 	"strings"
 
 	"github.com/livingpool/httpfromtcp/internal/headers"
@@ -16,7 +17,6 @@ type requestState int
 const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
-	requestStateParsingBody
 	requestStateDone
 )
 
@@ -25,11 +25,89 @@ const (
 	bufferSize = 8
 )
 
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 1 << 20
+	DefaultMaxHeaderFields     = 100
+)
+
+// Limits bounds how much of a request the parser is willing to buffer.
+// A zero field falls back to its default.
+type Limits struct {
+	// MaxRequestLineBytes caps the request-line, CRLF excluded. Going over it is reported as ErrURITooLong.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes caps the header section, the CRLF of each field line included.
+	MaxHeaderBytes int
+	// MaxHeaderFields caps the number of header fields.
+	MaxHeaderFields int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes <= 0 {
+		l.MaxRequestLineBytes = DefaultMaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if l.MaxHeaderFields <= 0 {
+		l.MaxHeaderFields = DefaultMaxHeaderFields
+	}
+	return l
+}
+
+// headerOptions returns the parse options for the next field line,
+// given that used bytes of the section have been parsed already.
+func (l Limits) headerOptions(used int, obsFold headers.ObsFold) (headers.ParseOptions, error) {
+	remaining := l.MaxHeaderBytes - used
+	if remaining <= 0 {
+		return headers.ParseOptions{}, fmt.Errorf("%w: more than %d bytes", headers.ErrHeaderTooLarge, l.MaxHeaderBytes)
+	}
+	return headers.ParseOptions{
+		MaxBytes:  remaining,
+		MaxFields: l.MaxHeaderFields,
+		ObsFold:   obsFold,
+	}, nil
+}
+
 type Request struct {
 	RequestLine  RequestLine
 	requestState requestState
-	Headers      headers.Headers
-	Body         []byte
+	Headers      *headers.Headers
+
+	// URL is the parsed RequestLine.RequestTarget, in the form given by TargetForm.
+	URL        *url.URL
+	TargetForm TargetForm
+
+	// Body streams the message body from the connection, decoding any
+	// transfer coding along the way. It is never nil.
+	Body io.ReadCloser
+
+	// ContentLength is the value of the Content-Length header,
+	// or -1 if the body is chunked and its length is unknown.
+	ContentLength int64
+
+	// Trailers is populated once a chunked Body has been read to EOF.
+	Trailers *headers.Headers
+
+	// Form holds the query parameters and urlencoded or multipart body fields.
+	// It is nil until ParseForm or ParseMultipartForm is called.
+	Form url.Values
+	// PostForm holds only the body fields. It is nil until ParseForm or ParseMultipartForm is called.
+	PostForm url.Values
+	// MultipartForm is the parsed multipart form, including file uploads.
+	// It is nil until ParseMultipartForm is called.
+	MultipartForm *multipart.Form
+
+	// RemoteAddr is the address of the client, set by the server.
+	RemoteAddr string
+
+	body          *body
+	query         url.Values
+	pathValues    map[string]string
+	multipartRead bool
+	limits        Limits
+	obsFold       headers.ObsFold
+	headerBytes   int
 }
 
 type RequestLine struct {
@@ -38,51 +116,57 @@ type RequestLine struct {
 	Method        string
 }
 
+// RequestFromReader parses the request line and headers from reader.
+// The body is not read up front; it is streamed from reader through Body.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
-	readToIndex := 0
+	return NewParser(reader).Next()
+}
+
+func readRequest(b *buffer, limits Limits, obsFold headers.ObsFold) (*Request, error) {
 	request := &Request{
 		requestState: requestStateInitialized,
 		Headers:      headers.NewHeaders(),
-		Body:         make([]byte, 0),
+		Trailers:     headers.NewHeaders(),
+		limits:       limits.withDefaults(),
+		obsFold:      obsFold,
 	}
 
-	for request.requestState != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
-		}
-
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+	for {
+		numBytesParsed, err := request.parse(b.data())
 		if err != nil {
-			if errors.Is(io.EOF, err) {
-				if request.requestState != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", request.requestState, numBytesRead)
-				}
-				break
-			}
 			return nil, err
 		}
-		readToIndex += numBytesRead
+		b.consume(numBytesParsed)
 
-		numBytesParsed, err := request.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
+		if request.requestState == requestStateDone {
+			break
 		}
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+		if err := b.fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("incomplete request, in state: %d, unparsed bytes on EOF: %d: %w", request.requestState, len(b.data()), io.ErrUnexpectedEOF)
+			}
+			return nil, err
+		}
 	}
 
+	if err := request.setBody(b); err != nil {
+		return nil, err
+	}
 	return request, nil
 }
 
-func parseRequestLine(data []byte) (*RequestLine, int, error) {
+func parseRequestLine(data []byte, maxBytes int) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
+		if len(data) > maxBytes {
+			return nil, 0, fmt.Errorf("%w: no CRLF in %d bytes", ErrURITooLong, len(data))
+		}
 		return nil, 0, nil
 	}
+	if idx > maxBytes {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrURITooLong, idx)
+	}
 
 	requestLineText := string(data[:idx])
 	requestLine, err := requestLineFromString(requestLineText)
@@ -94,32 +178,46 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 }
 
 func requestLineFromString(str string) (*RequestLine, error) {
+	if strings.ContainsAny(str, "\r\n") {
+		return nil, fmt.Errorf("%w: bare CR or LF", ErrMalformedRequestLine)
+	}
+
 	parts := strings.Split(str, " ")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("poorly formatted request-line: %s", str)
+		return nil, fmt.Errorf("%w: %s", ErrMalformedRequestLine, str)
 	}
 
 	method := parts[0]
+	if method == "" {
+		return nil, fmt.Errorf("%w: empty method", ErrMalformedRequestLine)
+	}
 	for _, c := range method {
 		if c < 'A' || c > 'Z' {
-			return nil, fmt.Errorf("invalid method: %s", method)
+			return nil, fmt.Errorf("%w: invalid method: %s", ErrMalformedRequestLine, method)
 		}
 	}
 
 	requestTarget := parts[1]
+	if requestTarget == "" {
+		return nil, fmt.Errorf("%w: empty request-target", ErrMalformedRequestLine)
+	}
 
 	versionParts := strings.Split(parts[2], "/")
 	if len(versionParts) != 2 {
-		return nil, fmt.Errorf("malformed start-line: %s", str)
+		return nil, fmt.Errorf("%w: %s", ErrMalformedRequestLine, str)
 	}
 
 	httpPart := versionParts[0]
 	if httpPart != "HTTP" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
+		return nil, fmt.Errorf("%w: unrecognized HTTP-version: %s", ErrMalformedRequestLine, httpPart)
 	}
 	version := versionParts[1]
-	if version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
+	if !validVersion(version) {
+		return nil, fmt.Errorf("%w: unrecognized HTTP-version: %s", ErrMalformedRequestLine, version)
+	}
+	// any HTTP/1.x is understood; a minor version above 1 is treated as 1.1. RFC 9110 2.5
+	if version[0] != '1' {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
 	}
 
 	return &RequestLine{
@@ -129,6 +227,15 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	}, nil
 }
 
+// validVersion checks the version number of an HTTP-version,
+// which is always a single digit, a dot and another digit. RFC 9112 2.3
+func validVersion(version string) bool {
+	return len(version) == 3 &&
+		version[0] >= '0' && version[0] <= '9' &&
+		version[1] == '.' &&
+		version[2] >= '0' && version[2] <= '9'
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.requestState != requestStateDone {
@@ -147,47 +254,88 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.requestState {
 	case requestStateInitialized:
-		requestLine, n, err := parseRequestLine(data)
+		requestLine, n, err := parseRequestLine(data, r.limits.MaxRequestLineBytes)
 		if err != nil { // something actually went wrong
 			return 0, err
 		}
 		if n == 0 { // just need more data
 			return 0, nil
 		}
+		u, form, err := parseTarget(requestLine.Method, requestLine.RequestTarget)
+		if err != nil {
+			return 0, err
+		}
 		r.RequestLine = *requestLine
+		r.URL = u
+		r.TargetForm = form
 		r.requestState = requestStateParsingHeaders
 		return n, nil
 	case requestStateParsingHeaders:
-		n, done, err := r.Headers.Parse(data)
+		opts, err := r.limits.headerOptions(r.headerBytes, r.obsFold)
 		if err != nil {
 			return 0, err
 		}
-		if done {
-			r.requestState = requestStateParsingBody
+		n, done, err := r.Headers.ParseWithOptions(data, opts)
+		if err != nil {
+			return 0, err
 		}
-		return n, nil
-	case requestStateParsingBody:
-		// assume if no content-type header is present, there is no body
-		if contentLength, exists := r.Headers.Get("Content-Length"); !exists {
+		r.headerBytes += n
+		if done {
 			r.requestState = requestStateDone
-			return 0, nil
-		} else {
-			r.Body = append(r.Body, data...)
-			leng, err := strconv.Atoi(contentLength)
-			if err != nil {
-				return len(r.Body), fmt.Errorf("Content-Length is not integer, got=%s", contentLength)
-			}
-			if len(r.Body) > leng {
-				return len(r.Body), fmt.Errorf("got more data then Content-Length, got=%d, expected:%d", len(r.Body), leng)
-			}
-			if len(r.Body) == leng {
-				r.requestState = requestStateDone
-			}
-			return len(data), nil
 		}
+		return n, nil
 	case requestStateDone:
 		return 0, fmt.Errorf("trying to read data from a requestStateDone requestState")
 	default:
 		return 0, fmt.Errorf("unknown requestState")
 	}
 }
+
+// setBody picks the body framing from the parsed headers. RFC 9112 6.3
+func (r *Request) setBody(b *buffer) error {
+	chunked, contentLength, err := bodyFraming(r.Headers, r.ProtoAtLeast(1, 1))
+	if err != nil {
+		return err
+	}
+	r.ContentLength = contentLength
+
+	switch {
+	case chunked:
+		r.body = &body{src: &chunkedReader{buf: b, trailers: r.Trailers, limits: r.limits, obsFold: r.obsFold}}
+		r.Body = r.body
+	case contentLength > 0:
+		r.body = &body{src: &contentLengthReader{buf: b, remaining: contentLength}}
+		r.Body = r.body
+	default:
+		r.Body = NoBody
+	}
+	return nil
+}
+
+// ProtoAtLeast reports whether the HTTP version of the request is at least major.minor.
+func (r *Request) ProtoAtLeast(major, minor int) bool {
+	version := r.RequestLine.HttpVersion
+	if !validVersion(version) {
+		return false
+	}
+	reqMajor, reqMinor := int(version[0]-'0'), int(version[2]-'0')
+	return reqMajor > major || reqMajor == major && reqMinor >= minor
+}
+
+// KeepAlive reports whether the client wants the connection to stay open
+// after this request. HTTP/1.1 connections persist unless the client sends
+// "Connection: close", HTTP/1.0 ones only with "Connection: keep-alive". RFC 9112 9.3
+func (r *Request) KeepAlive() bool {
+	connection, _ := r.Headers.Get("Connection")
+	keepAlive := r.ProtoAtLeast(1, 1)
+	for _, option := range strings.Split(connection, ",") {
+		option = strings.TrimSpace(option)
+		if strings.EqualFold(option, "close") {
+			return false
+		}
+		if strings.EqualFold(option, "keep-alive") {
+			keepAlive = true
+		}
+	}
+	return keepAlive
+}
@@ -1,9 +1,14 @@
 package request
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/livingpool/httpfromtcp/internal/headers"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,6 +75,144 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestHTTPVersions(t *testing.T) {
+	// Test: HTTP/1.0 without Host closes by default
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.ProtoAtLeast(1, 1))
+	assert.True(t, r.ProtoAtLeast(1, 0))
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 asking for keep-alive
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 with a Content-Length body
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.0\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: HTTP/1.0 with Transfer-Encoding
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrAmbiguousFraming)
+
+	// Test: Higher HTTP/1.x minor version is understood as HTTP/1.1
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.2\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.ProtoAtLeast(1, 1))
+	assert.True(t, r.KeepAlive())
+
+	// Test: Unsupported major versions
+	for _, version := range []string{"0.9", "2.0", "3.0"} {
+		reader = &chunkReader{
+			data:            "GET / HTTP/" + version + "\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ErrUnsupportedVersion, version)
+	}
+}
+
+func TestRequestTargetParse(t *testing.T) {
+	// Test: Origin-form with query
+	reader := &chunkReader{
+		data:            "GET /video?x=1&name=vim%20demo&x=2 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, r.TargetForm)
+	assert.Equal(t, "/video", r.Path())
+	assert.Equal(t, "x=1&name=vim%20demo&x=2", r.RawQuery())
+	assert.Equal(t, []string{"1", "2"}, r.Query()["x"])
+	assert.Equal(t, "vim demo", r.Query().Get("name"))
+
+	// Test: Origin-form with percent-encoded path
+	reader = &chunkReader{
+		data:            "GET /my%20files/a%2Fb HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/my files/a/b", r.Path())
+	assert.Equal(t, "", r.RawQuery())
+	assert.Empty(t, r.Query())
+
+	// Test: Absolute-form
+	reader = &chunkReader{
+		data:            "GET http://example.com:8080/coffee?milk=oat HTTP/1.1\r\nHost: example.com:8080\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.TargetForm)
+	assert.Equal(t, "example.com:8080", r.URL.Host)
+	assert.Equal(t, "/coffee", r.Path())
+	assert.Equal(t, "oat", r.Query().Get("milk"))
+
+	// Test: Authority-form
+	reader = &chunkReader{
+		data:            "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.TargetForm)
+	assert.Equal(t, "example.com:443", r.URL.Host)
+	assert.Equal(t, "", r.Path())
+
+	// Test: Asterisk-form
+	reader = &chunkReader{
+		data:            "OPTIONS * HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.TargetForm)
+	assert.Equal(t, "*", r.Path())
+
+	// Test: Invalid targets
+	for _, line := range []string{
+		"GET * HTTP/1.1",
+		"CONNECT /coffee HTTP/1.1",
+		"CONNECT example.com HTTP/1.1",
+		"GET coffee HTTP/1.1",
+		"GET /coffee#beans HTTP/1.1",
+		"GET /bad%zzescape HTTP/1.1",
+	} {
+		reader = &chunkReader{
+			data:            line + "\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, ErrInvalidTarget, line)
+	}
+}
+
 func TestHeadersParse(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -79,9 +222,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -91,7 +234,7 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Empty(t, r.Headers)
+	assert.Equal(t, 0, r.Headers.Len())
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -109,7 +252,9 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, duplicate:8080", r.Headers["host"])
+	assert.Equal(t, []string{"localhost:42069", "duplicate:8080"}, r.Headers.Values("host"))
+	host, _ := r.Headers.Get("host")
+	assert.Equal(t, "localhost:42069, duplicate:8080", host)
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -119,8 +264,8 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -131,6 +276,29 @@ func TestHeadersParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestObsFold(t *testing.T) {
+	// Test: Folded line rejected by default
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Long: first\r\n\tsecond\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err := RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrObsFold)
+
+	// Test: Folded lines replaced with a space
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Long: first\r\n\tsecond \r\n   third\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p := NewParser(reader)
+	p.ObsFold = headers.ObsFoldReplace
+	r, err := p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first second third"}, r.Headers.Values("x-long"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
+	assert.Equal(t, 3, r.Headers.Len())
+}
+
 func TestBodyParse(t *testing.T) {
 	// Test: Standard Body
 	reader := &chunkReader{
@@ -144,7 +312,9 @@ func TestBodyParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
 
 	// Test: Empty Body, 0 reported content length
 	reader = &chunkReader{
@@ -157,7 +327,9 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -169,6 +341,8 @@ func TestBodyParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
 	require.Error(t, err)
 
 	// Test: No Content-Length but Body Exists
@@ -182,7 +356,651 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+
+	// Test: Reading a closed body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(make([]byte, 8))
+	require.ErrorIs(t, err, ErrBodyReadAfterClose)
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	// Test: Body within the limit
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	body, err := io.ReadAll(MaxBytesReader(r.Body, 13))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Chunked body over the limit
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	body, err = io.ReadAll(MaxBytesReader(r.Body, 8))
+	var maxBytesErr *MaxBytesError
+	require.ErrorAs(t, err, &maxBytesErr)
+	assert.Equal(t, int64(8), maxBytesErr.Limit)
+	assert.Equal(t, "hello wo", string(body))
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// Test: Uppercase hex chunk size and chunk extensions
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"1A;name=value;flag\r\nabcdefghijklmnopqrstuvwxyz\r\n" +
+			"3 ; quoted=\"a b\"\r\n123\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz123", string(body))
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"4\r\nwiki\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "wiki", string(body))
+	assert.Equal(t, []string{"abc123"}, r.Trailers.Values("x-checksum"))
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"xyz\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Chunk data longer than chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Missing terminating chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.Error(t, err)
+
+	// Test: Chunk extension that never ends fails early, not at EOF
+	head := "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n"
+	endless := &countingReader{r: io.LimitReader(repeatReader('a'), 64<<20)}
+	r, err = RequestFromReader(io.MultiReader(strings.NewReader(head+"5;ext="), endless))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrLineTooLong)
+	assert.Less(t, endless.n, int64(64<<10))
+
+	// Test: Trailer line that never ends
+	endless = &countingReader{r: io.LimitReader(repeatReader('a'), 64<<20)}
+	r, err = RequestFromReader(io.MultiReader(strings.NewReader(head+"0\r\nX-Trailer: "), endless))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, headers.ErrHeaderTooLarge)
+	assert.Less(t, endless.n, int64(64<<10))
+}
+
+func TestChunkExtensions(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		valid bool
+	}{
+		{"name only", "3;flag", true},
+		{"token value", "3;name=value", true},
+		{"several extensions with BWS", "3 ; a = b ;c\t;\td=e", true},
+		{"quoted value", `3;x="a b"`, true},
+		{"semicolon inside quotes", `3;x="a;b"`, true},
+		{"escaped quote", `3;x="a\"b"`, true},
+		{"escaped backslash", `3;x="a\\"`, true},
+		{"empty quoted value", `3;x=""`, true},
+		{"obs-text in quotes", "3;x=\"caf\xe9\"", true},
+		{"unterminated quote", `3;x="ab`, false},
+		{"escape at end of line", `3;x="a\`, false},
+		{"quote inside quoted value", `3;x="a"b"`, false},
+		{"DEL in quotes", "3;x=\"a\x7fb\"", false},
+		{"missing name", "3;=b", false},
+		{"missing value", "3;a=", false},
+		{"empty extension", "3;", false},
+		{"empty extension between", "3;a;;b", false},
+		{"space inside token value", "3;a=b c", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, n, err := parseChunkSize([]byte(tt.line + "\r\n"))
+			if !tt.valid {
+				require.ErrorIs(t, err, ErrMalformedChunk)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), size)
+			assert.Equal(t, len(tt.line)+2, n)
+		})
+	}
+}
+
+// repeatReader yields its byte forever.
+type repeatReader byte
+
+func (b repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func TestFormParse(t *testing.T) {
+	// Test: Urlencoded body and query
+	reader := &chunkReader{
+		data: "POST /submit?source=query&name=ignored HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Length: 27\r\n" +
+			"\r\n" +
+			"name=prime&langs=go&langs=z",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "prime", r.FormValue("name"))
+	assert.Equal(t, "query", r.FormValue("source"))
+	assert.Equal(t, "", r.PostFormValue("source"))
+	assert.Equal(t, []string{"go", "z"}, r.PostForm["langs"])
+	assert.Equal(t, []string{"prime", "ignored"}, r.Form["name"])
+
+	// Test: GET only uses the query
+	reader = &chunkReader{
+		data:            "GET /search?q=zig HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "zig", r.FormValue("q"))
+	assert.Empty(t, r.PostForm)
+
+	// Test: Multipart form with a file
+	multipartBody := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"vim tricks\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"video\"; filename=\"vim.mp4\"\r\n" +
+		"Content-Type: video/mp4\r\n" +
+		"\r\n" +
+		"not really a video\r\n" +
+		"--xyz--\r\n"
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=xyz\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(multipartBody), multipartBody),
+		numBytesPerRead: 7,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ParseMultipartForm(4))
+	defer r.MultipartForm.RemoveAll()
+	assert.Equal(t, "vim tricks", r.FormValue("title"))
+	f, fh, err := r.FormFile("video")
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, "vim.mp4", fh.Filename)
+	_, spilled := f.(*os.File)
+	assert.True(t, spilled, "file part over maxMemory should be on disk")
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "not really a video", string(content))
+
+	// Test: Streaming multipart parts
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=xyz\r\n" +
+			fmt.Sprintf("Content-Length: %d\r\n", len(multipartBody)) +
+			"\r\n" +
+			multipartBody,
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	mr, err := r.MultipartReader()
+	require.NoError(t, err)
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.FormName())
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "vim.mp4", part.FileName())
+	content, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "not really a video", string(content))
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+	_, err = r.MultipartReader()
+	require.ErrorIs(t, err, ErrMultipartRead)
+
+	// Test: Multipart methods on a non-multipart request
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.MultipartReader()
+	require.ErrorIs(t, err, ErrNotMultipart)
+
+	// Test: Multipart without boundary
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Type: multipart/form-data\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ParseMultipartForm(1024), ErrMissingBoundary)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		err  error
+	}{
+		{"CL.TE", "Content-Length: 6\r\nTransfer-Encoding: chunked\r\n", ErrAmbiguousFraming},
+		{"TE.CL", "Transfer-Encoding: chunked\r\nContent-Length: 6\r\n", ErrAmbiguousFraming},
+		{"chunked not final", "Transfer-Encoding: chunked, identity\r\n", ErrAmbiguousFraming},
+		{"chunked not final across fields", "Transfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n", ErrAmbiguousFraming},
+		{"chunked applied twice", "Transfer-Encoding: chunked, chunked\r\n", ErrAmbiguousFraming},
+		{"empty Transfer-Encoding", "Transfer-Encoding: \r\n", ErrAmbiguousFraming},
+		{"obfuscated chunked", "Transfer-Encoding: xchunked\r\n", ErrAmbiguousFraming},
+		{"unknown coding before chunked", "Transfer-Encoding: gzip, chunked\r\n", ErrUnsupportedTransferCoding},
+		{"conflicting Content-Length", "Content-Length: 5\r\nContent-Length: 6\r\n", ErrBadContentLength},
+		{"conflicting Content-Length list", "Content-Length: 5, 6\r\n", ErrBadContentLength},
+		{"empty Content-Length list element", "Content-Length: 5,\r\n", ErrBadContentLength},
+		{"signed Content-Length", "Content-Length: +5\r\n", ErrBadContentLength},
+		{"hex Content-Length", "Content-Length: 0x5\r\n", ErrBadContentLength},
+		{"Content-Length with inner space", "Content-Length: 1 5\r\n", ErrBadContentLength},
+		{"Content-Length with vertical tab", "Content-Length: \x0b5\r\n", headers.ErrInvalidFieldValue},
+		{"Content-Length with form feed", "Content-Length: 5\x0c\r\n", headers.ErrInvalidFieldValue},
+		{"Content-Length overflow", "Content-Length: 99999999999999999999\r\n", ErrBadContentLength},
+		{"space before colon", "Transfer-Encoding : chunked\r\n", headers.ErrMalformedFieldLine},
+		{"tab before colon", "Content-Length\t: 5\r\n", headers.ErrMalformedFieldLine},
+		{"bare LF in field line", "X-Foo: bar\nTransfer-Encoding: chunked\r\n", headers.ErrMalformedFieldLine},
+		{"NUL in field value", "Content-Length: 5\x00\r\n", headers.ErrInvalidFieldValue},
+		{"bare CR in field line", "X-Foo: bar\rContent-Length: 5\r\n", headers.ErrMalformedFieldLine},
+		{"folded Transfer-Encoding", "Transfer-Encoding:\r\n chunked\r\n", headers.ErrObsFold},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &chunkReader{
+				data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\n" + tt.head + "\r\n0\r\n\r\n",
+				numBytesPerRead: 1024,
+			}
+			_, err := RequestFromReader(reader)
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+
+	// Test: Whitespace before the first field line does not hide a Transfer-Encoding
+	_, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\nHost: x\r\n\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, headers.ErrMalformedFieldLine)
+
+	// Test: Repeated, identical Content-Length values are merged
+	reader := &chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), r.ContentLength)
+
+	// Test: Bare LF in the request-line
+	reader = &chunkReader{
+		data:            "GET /\nGET /admin HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Chunk size vectors
+	for _, chunk := range []string{
+		"5 \r\nhello\r\n0\r\n\r\n",                              // trailing whitespace without an extension
+		" 5\r\nhello\r\n0\r\n\r\n",                              // leading whitespace
+		"0x5\r\nhello\r\n0\r\n\r\n",                             // hex prefix
+		"-5\r\nhello\r\n0\r\n\r\n",                              // sign
+		"10000000000000000\r\nhello\r\n0\r\n\r\n",               // overflows int64
+		"5\nhello\r\n0\r\n\r\n",                                 // bare LF after the chunk size
+		"5\r\nhelloXX0\r\n\r\n",                                 // chunk data longer than announced
+		"5\r\nhello\r\n0\r\nX: y\nTransfer-Encoding: x\r\n\r\n", // bare LF in a trailer
+	} {
+		reader = &chunkReader{
+			data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n" + chunk,
+			numBytesPerRead: 3,
+		}
+		r, err = RequestFromReader(reader)
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		require.Error(t, err, "%q", chunk)
+	}
+}
+
+func TestParserNext(t *testing.T) {
+	// Test: Pipelined requests on one connection
+	reader := &chunkReader{
+		data: "GET /first HTTP/1.1\r\nHost: localhost:42069\r\n\r\n" +
+			"POST /second HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello" +
+			"POST /third HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+			"GET /fourth HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	p := NewParser(reader)
+
+	r, err := p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.True(t, r.KeepAlive())
+
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// the body of the third request is left unread
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+	require.NoError(t, r.Body.Close())
+
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/fourth", r.RequestLine.RequestTarget)
+	assert.False(t, r.KeepAlive())
+
+	_, err = p.Next()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection closed in the middle of a request
+	reader = &chunkReader{
+		data:            "GET /first HTTP/1.1\r\nHost: localhost:42069\r\n\r\nGET /sec",
+		numBytesPerRead: 4,
+	}
+	p = NewParser(reader)
+	_, err = p.Next()
+	require.NoError(t, err)
+	_, err = p.Next()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+
+	// Test: Unread body up to MaxDrainBytes is discarded, a larger one is not
+	for _, size := range []int{MaxDrainBytes, MaxDrainBytes + 1} {
+		body := strings.Repeat("a", size)
+		reader = &chunkReader{
+			data: fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: %d\r\n\r\n%s", size, body) +
+				"GET /next HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 4096,
+		}
+		p = NewParser(reader)
+		_, err = p.Next()
+		require.NoError(t, err)
+		r, err = p.Next()
+		if size > MaxDrainBytes {
+			require.ErrorIs(t, err, ErrUnreadBody)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"missing request-target", "GET HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"lowercase method", "get / HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"malformed version", "GET / HTTP/one\r\n\r\n", ErrMalformedRequestLine},
+		{"unsupported version", "GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion},
+		{"request-line too long", "GET /" + strings.Repeat("a", DefaultMaxRequestLineBytes) + " HTTP/1.1\r\n\r\n", ErrURITooLong},
+		{"unterminated request-line", "GET /" + strings.Repeat("a", DefaultMaxRequestLineBytes+1), ErrURITooLong},
+		{"bad header token", "GET / HTTP/1.1\r\nH@st: localhost\r\n\r\n", headers.ErrInvalidToken},
+		{"missing colon", "GET / HTTP/1.1\r\nHost\r\n\r\n", headers.ErrMalformedFieldLine},
+		{"header too large", "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", DefaultMaxHeaderBytes) + "\r\n\r\n", headers.ErrHeaderTooLarge},
+		{"negative Content-Length", "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", ErrBadContentLength},
+		{"non-numeric Content-Length", "POST / HTTP/1.1\r\nContent-Length: ten\r\n\r\n", ErrBadContentLength},
+		{"incomplete request", "GET / HTTP/1.1\r\nHost: localhost", io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &chunkReader{
+				data:            tt.data,
+				numBytesPerRead: 1024,
+			}
+			_, err := RequestFromReader(reader)
+			require.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestParserLimits(t *testing.T) {
+	// Test: Request-line at MaxRequestLineBytes
+	reader := &chunkReader{
+		data:            "GET /abcdef HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p := NewParser(reader)
+	p.Limits = Limits{MaxRequestLineBytes: 20}
+	r, err := p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/abcdef", r.RequestLine.RequestTarget)
+
+	// Test: Request-line over MaxRequestLineBytes
+	reader = &chunkReader{
+		data:            "GET /abcdefg HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxRequestLineBytes: 20}
+	_, err = p.Next()
+	require.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: Header section at MaxHeaderBytes
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxHeaderBytes: 38}
+	_, err = p.Next()
+	require.NoError(t, err)
+
+	// Test: Header section over MaxHeaderBytes
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxHeaderBytes: 37}
+	_, err = p.Next()
+	require.ErrorIs(t, err, headers.ErrHeaderTooLarge)
+
+	// Test: Never-ending field line
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Forever: " + strings.Repeat("a", 4096),
+		numBytesPerRead: 64,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxHeaderBytes: 1024}
+	_, err = p.Next()
+	require.ErrorIs(t, err, headers.ErrHeaderTooLarge)
+
+	// Test: Header fields at MaxHeaderFields
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxHeaderFields: 2}
+	_, err = p.Next()
+	require.NoError(t, err)
+
+	// Test: Header fields over MaxHeaderFields
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\nUser-Agent: curl/7.81.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxHeaderFields: 2}
+	_, err = p.Next()
+	require.ErrorIs(t, err, headers.ErrHeaderTooLarge)
+
+	// Test: Trailer fields share the header limits
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"0\r\nX-One: 1\r\nX-Two: 2\r\nX-Three: 3\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	p = NewParser(reader)
+	p.Limits = Limits{MaxHeaderFields: 2}
+	r, err = p.Next()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, headers.ErrHeaderTooLarge)
 }
 
 type chunkReader struct {
@@ -212,3 +1030,64 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+func TestRequestWrite(t *testing.T) {
+	// Test: Request without a body
+	r, err := NewRequest("GET", "http://localhost:42069/video?x=1#part", nil)
+	require.NoError(t, err)
+	r.Headers.Set("Accept", "*/*")
+	var buf strings.Builder
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "GET /video?x=1 HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\n\r\n", buf.String())
+
+	// Test: Body of a known length
+	r, err = NewRequest("POST", "http://localhost/form", strings.NewReader("a=1&b=2"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), r.ContentLength)
+	r.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Headers.Set("Content-Length", "1000") // replaced by the real one
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST /form HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 7\r\n\r\na=1&b=2", buf.String())
+
+	// Test: Empty POST
+	r, err = NewRequest("POST", "http://localhost/", nil)
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n", buf.String())
+
+	// Test: Body of an unknown length is chunked, with trailers
+	r, err = NewRequest("PUT", "https://example.com/upload", io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	r.Trailers.Set("X-Checksum", "abc")
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "PUT /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"6\r\nhello \r\n5\r\nworld\r\n0\r\nX-Checksum: abc\r\n\r\n", buf.String())
+
+	// Test: What Write sends, the parser reads back
+	parsed, err := RequestFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "PUT", parsed.RequestLine.Method)
+	body, err := io.ReadAll(parsed.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	checksum, _ := parsed.Trailers.Get("X-Checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: Body shorter than its Content-Length
+	r, err = NewRequest("POST", "http://localhost/", strings.NewReader("short"))
+	require.NoError(t, err)
+	r.ContentLength = 10
+	require.ErrorIs(t, r.Write(io.Discard), ErrBadContentLength)
+
+	// Test: Invalid requests
+	_, err = NewRequest("GET", "/relative", nil)
+	require.ErrorIs(t, err, ErrInvalidTarget)
+	_, err = NewRequest("GET", "ftp://example.com/", nil)
+	require.ErrorIs(t, err, ErrInvalidTarget)
+	_, err = NewRequest("BAD METHOD", "http://example.com/", nil)
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+}
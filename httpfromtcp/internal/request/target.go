@@ -0,0 +1,116 @@
+package request
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TargetForm is the form of a request-target. RFC 9112 3.2
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query, e.g. "/video?x=1".
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, as sent to proxies, e.g. "http://example.com/video".
+	AbsoluteForm
+	// AuthorityForm is a host and port, only used by CONNECT, e.g. "example.com:443".
+	AuthorityForm
+	// AsteriskForm is a lone "*", only used by a server-wide OPTIONS.
+	AsteriskForm
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case OriginForm:
+		return "origin-form"
+	case AbsoluteForm:
+		return "absolute-form"
+	case AuthorityForm:
+		return "authority-form"
+	case AsteriskForm:
+		return "asterisk-form"
+	default:
+		return fmt.Sprintf("TargetForm(%d)", int(f))
+	}
+}
+
+// parseTarget works out the form of a request-target and parses it into a URL.
+func parseTarget(method, target string) (*url.URL, TargetForm, error) {
+	switch {
+	case method == "CONNECT":
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return nil, 0, fmt.Errorf("%w: CONNECT needs host:port, got %s", ErrInvalidTarget, target)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid port: %s", ErrInvalidTarget, target)
+		}
+		return &url.URL{Host: target}, AuthorityForm, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, 0, fmt.Errorf("%w: * is only allowed for OPTIONS", ErrInvalidTarget)
+		}
+		return &url.URL{Path: "*"}, AsteriskForm, nil
+	case strings.HasPrefix(target, "/"):
+		if strings.Contains(target, "#") {
+			return nil, 0, fmt.Errorf("%w: fragment in request-target: %s", ErrInvalidTarget, target)
+		}
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+		}
+		return u, OriginForm, nil
+	default:
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+		}
+		if u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+			return nil, 0, fmt.Errorf("%w: not an absolute URI: %s", ErrInvalidTarget, target)
+		}
+		return u, AbsoluteForm, nil
+	}
+}
+
+// Path returns the decoded path of the request-target,
+// or "" for the authority-form used by CONNECT.
+func (r *Request) Path() string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.Path
+}
+
+// RawQuery returns the query of the request-target as sent, without the "?".
+func (r *Request) RawQuery() string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.RawQuery
+}
+
+// Query returns the parsed query of the request-target.
+// Malformed pairs are skipped.
+func (r *Request) Query() url.Values {
+	if r.query == nil {
+		r.query, _ = url.ParseQuery(r.RawQuery())
+	}
+	return r.query
+}
+
+// PathValue returns the value of the named wildcard in the route pattern
+// that matched the request, or "" if there is none. The router sets it.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets the named wildcard to value, for PathValue to return.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
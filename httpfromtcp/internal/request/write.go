@@ -0,0 +1,158 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+)
+
+// NewRequest returns a request to send to the absolute http or https URL
+// target, with body as its content. The Content-Length is taken from body
+// when it is a *bytes.Buffer, *bytes.Reader or *strings.Reader; any other
+// body is sent chunked. body may be nil.
+func NewRequest(method, target string, body io.Reader) (*Request, error) {
+	if method == "" || !headers.IsToken(method) {
+		return nil, fmt.Errorf("%w: invalid method: %q", ErrMalformedRequestLine, method)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTarget, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%w: not an absolute http URL: %s", ErrInvalidTarget, target)
+	}
+	u.Fragment = "" // never sent. RFC 9110 4.2.1
+
+	r := &Request{
+		RequestLine: RequestLine{
+			Method:        method,
+			RequestTarget: u.RequestURI(),
+			HttpVersion:   "1.1",
+		},
+		Headers:       headers.NewHeaders(),
+		URL:           u,
+		TargetForm:    AbsoluteForm,
+		Body:          NoBody,
+		ContentLength: 0,
+		Trailers:      headers.NewHeaders(),
+	}
+	r.Headers.Set("Host", u.Host)
+
+	if body != nil {
+		switch b := body.(type) {
+		case *bytes.Buffer:
+			r.ContentLength = int64(b.Len())
+		case *bytes.Reader:
+			r.ContentLength = int64(b.Len())
+		case *strings.Reader:
+			r.ContentLength = int64(b.Len())
+		default:
+			r.ContentLength = -1
+		}
+		if r.ContentLength != 0 {
+			rc, ok := body.(io.ReadCloser)
+			if !ok {
+				rc = io.NopCloser(body)
+			}
+			r.Body = rc
+		}
+	}
+	return r, nil
+}
+
+// Write sends r to w as a client would: the request-line in origin-form,
+// the headers and the body. Framing headers are replaced by ones matching
+// ContentLength: a Content-Length when it is known, chunked when it is -1,
+// in which case Trailers follow the body. Write does not close Body.
+func (r *Request) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	target := r.RequestLine.RequestTarget
+	if r.URL != nil && r.TargetForm == AbsoluteForm {
+		target = r.URL.RequestURI()
+	}
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/%s\r\n", r.RequestLine.Method, target, version)
+
+	h := r.Headers.Clone()
+	if _, hasHost := h.Get("Host"); !hasHost && r.URL != nil && r.URL.Host != "" {
+		h.Set("Host", r.URL.Host)
+	}
+	h.Del("Content-Length")
+	h.Del("Transfer-Encoding")
+
+	body := r.Body
+	if body == nil {
+		body = NoBody
+	}
+	chunked := r.ContentLength < 0
+	switch {
+	case chunked:
+		h.Set("Transfer-Encoding", "chunked")
+	case r.ContentLength > 0 || methodHasContent(r.RequestLine.Method):
+		// a request without Transfer-Encoding whose method gives content a
+		// meaning should say it has none. RFC 9110 8.6
+		h.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+	h.WriteTo(bw)
+	bw.WriteString(crlf)
+
+	if chunked {
+		if err := writeChunked(bw, body, r.Trailers); err != nil {
+			return err
+		}
+	} else if r.ContentLength > 0 {
+		n, err := io.CopyN(bw, body, r.ContentLength)
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: body ended after %d of %d bytes", ErrBadContentLength, n, r.ContentLength)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeChunked sends body with the chunked transfer coding, a chunk for each
+// read, followed by the last chunk and trailers. RFC 9112 7.1
+func writeChunked(bw *bufio.Writer, body io.Reader, trailers *headers.Headers) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString(crlf)
+			// send each chunk as it comes, the body may be a stream
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	bw.WriteString("0\r\n")
+	if trailers != nil {
+		trailers.WriteTo(bw)
+	}
+	_, err := bw.WriteString(crlf)
+	return err
+}
+
+func methodHasContent(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
@@ -0,0 +1,122 @@
+package response
+
+import (
+	"errors"
+	"io"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+)
+
+// DefaultChunkSize is the chunk size of a ChunkedWriter made with NewChunkedWriter.
+const DefaultChunkSize = 32 << 10
+
+// ChunkedWriter streams a chunked body through a Writer. Writes are collected
+// into chunks of a set size, so many small writes do not each become a
+// chunk of their own. Flush sends what has been collected so far, and Close
+// ends the body with the last chunk and any trailers.
+//
+// To HTTP/1.0 clients the body goes out as is, and the trailers are dropped.
+type ChunkedWriter struct {
+	w   *Writer
+	buf []byte
+	// Trailers, if set before Close, are sent after the last chunk. Announce
+	// them in a Trailer header so the client knows to expect them.
+	Trailers *headers.Headers
+	closed   bool
+}
+
+// NewChunkedWriter returns a ChunkedWriter writing chunks of DefaultChunkSize to w.
+func NewChunkedWriter(w *Writer) *ChunkedWriter {
+	return NewChunkedWriterSize(w, DefaultChunkSize)
+}
+
+// NewChunkedWriterSize returns a ChunkedWriter writing chunks of size bytes to w.
+// A size of 0 or less means DefaultChunkSize.
+func NewChunkedWriterSize(w *Writer, size int) *ChunkedWriter {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	return &ChunkedWriter{w: w, buf: make([]byte, 0, size)}
+}
+
+// Write collects p, sending a chunk each time the chunk size is reached.
+func (cw *ChunkedWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, ErrResponseDone
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(cw.buf[len(cw.buf):cap(cw.buf)], p)
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		written += n
+		p = p[n:]
+		if len(cw.buf) == cap(cw.buf) {
+			if err := cw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom reads r until EOF straight into the chunk buffer, sending a chunk
+// each time it fills up. io.Copy uses it.
+func (cw *ChunkedWriter) ReadFrom(r io.Reader) (int64, error) {
+	if cw.closed {
+		return 0, ErrResponseDone
+	}
+	var total int64
+	for {
+		if len(cw.buf) == cap(cw.buf) {
+			if err := cw.flush(); err != nil {
+				return total, err
+			}
+		}
+		n, err := r.Read(cw.buf[len(cw.buf):cap(cw.buf)])
+		cw.buf = cw.buf[:len(cw.buf)+n]
+		total += int64(n)
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Flush sends what has been written so far as a chunk, along with the
+// status line and headers if they have not gone out yet.
+func (cw *ChunkedWriter) Flush() error {
+	if cw.closed {
+		return ErrResponseDone
+	}
+	return cw.flush()
+}
+
+func (cw *ChunkedWriter) flush() error {
+	_, err := cw.w.WriteChunkedBody(cw.buf)
+	cw.buf = cw.buf[:0]
+	return err
+}
+
+// Close flushes what is left, writes the last chunk and the trailers, and
+// finishes the response. It does not close the connection.
+func (cw *ChunkedWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	if err := cw.flush(); err != nil {
+		return err
+	}
+	cw.closed = true
+
+	if _, err := cw.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	if cw.Trailers != nil {
+		if err := cw.w.WriteTrailers(cw.Trailers); err != nil {
+			return err
+		}
+	}
+	return cw.w.Finish()
+}
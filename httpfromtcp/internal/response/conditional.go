@@ -0,0 +1,169 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+)
+
+// StrongETag returns a strong entity tag for content, taken from its SHA-256
+// hash, so it changes whenever a byte of the content does. RFC 9110 8.8.3
+func StrongETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WeakETag returns a weak entity tag made from the size and modification time
+// of content too large to hash on every request, such as a file on disk.
+// Being weak, it is good for caching but not for If-Range. RFC 9110 8.8.1
+func WeakETag(size int64, modtime time.Time) string {
+	return fmt.Sprintf(`W/"%x-%x"`, modtime.UnixNano(), size)
+}
+
+// FileETag is the strong form of WeakETag, for files whose modification time
+// changes whenever their content does. Being strong, it lets If-Range resume
+// a download with the same tag. A file rewritten in place without its
+// modification time moving on would keep its tag. RFC 9110 8.8.3
+func FileETag(size int64, modtime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modtime.UnixNano(), size)
+}
+
+// EvaluatePreconditions evaluates the conditional headers of req against the
+// current representation, whose entity tag is etag ("" for none) and which
+// was last modified at modtime (zero if unknown), in the order of
+// RFC 9110 13.2.2. It returns StatusNotModified or StatusPreconditionFailed
+// when the request is to be answered with that instead, and StatusOK when it
+// may go ahead. If-Range is left to ServeContent.
+func EvaluatePreconditions(req *request.Request, etag string, modtime time.Time) StatusCode {
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+	modtime = modtime.Truncate(time.Second) // HTTP dates have no finer resolution
+
+	if ifMatch, ok := req.Headers.Get("If-Match"); ok {
+		if !matchETags(ifMatch, etag, strongMatch) {
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := parseDateHeader(req, "If-Unmodified-Since"); ok && !modtime.IsZero() {
+		if modtime.After(since) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, ok := req.Headers.Get("If-None-Match"); ok {
+		if matchETags(ifNoneMatch, etag, weakMatch) {
+			if safe {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := parseDateHeader(req, "If-Modified-Since"); ok && safe && !modtime.IsZero() {
+		if !modtime.After(since) {
+			return StatusNotModified
+		}
+	}
+
+	return StatusOK
+}
+
+// CheckPreconditions evaluates the preconditions of req against the ETag
+// in h and modtime, and when they stop the request writes the 304 or 412
+// response in its place. It reports whether it did, in which case the
+// response is finished. A 304 keeps the headers of h that a cache uses to
+// update what it has stored. RFC 9110 15.4.5
+func CheckPreconditions(w *Writer, req *request.Request, h *headers.Headers, modtime time.Time) (bool, error) {
+	etag, _ := h.Get("ETag")
+	code := EvaluatePreconditions(req, etag, modtime)
+	if code == StatusOK {
+		return false, nil
+	}
+
+	kept := headers.NewHeaders()
+	if code == StatusNotModified {
+		for _, f := range h.Fields() {
+			switch headers.CanonicalName(f.Name) {
+			case "Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Vary":
+				kept.Add(f.Name, f.Value)
+			case "Last-Modified":
+				if etag == "" { // only useful to caches without an entity tag
+					kept.Add(f.Name, f.Value)
+				}
+			}
+		}
+	}
+	if err := w.WriteStatusLine(code); err != nil {
+		return true, err
+	}
+	if err := w.WriteHeaders(kept); err != nil {
+		return true, err
+	}
+	return true, w.Finish()
+}
+
+// matchETags reports whether the list of entity tags in value, or "*",
+// matches etag. RFC 9110 13.1.1, 13.1.2
+func matchETags(value, etag string, match func(a, b string) bool) bool {
+	if strings.TrimSpace(value) == "*" {
+		return true // the representation exists, or we would not be here
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range etagList(value) {
+		if match(tag, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagList splits a list of entity tags, stopping at the first malformed one.
+// Tags are found by their quotes, as they may contain commas.
+func etagList(s string) []string {
+	var tags []string
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags
+		}
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if len(s) <= start || s[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, s[:end])
+		s = s[end:]
+	}
+}
+
+// strongMatch reports whether a and b are the same strong entity tag. RFC 9110 8.8.3.2
+func strongMatch(a, b string) bool {
+	return a == b && !strings.HasPrefix(a, "W/")
+}
+
+// weakMatch reports whether a and b are the same entity tag, weak or not.
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// parseDateHeader returns the date in the named header of req. An invalid
+// date is treated as no header at all. RFC 9110 13.1.3
+func parseDateHeader(req *request.Request, name string) (time.Time, bool) {
+	value, ok := req.Headers.Get(name)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := headers.ParseTime(strings.TrimSpace(value))
+	return t, err == nil
+}
@@ -0,0 +1,278 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+)
+
+// maxRanges is the most ranges a request may ask for before
+// the Range header is ignored and the whole content sent.
+const maxRanges = 100
+
+// ErrUnsatisfiableRange is returned by ParseRange when none of the ranges
+// overlap the content.
+var ErrUnsatisfiableRange = errors.New("range not satisfiable")
+
+// ByteRange is a range of bytes of the content, Length bytes from Start.
+type ByteRange struct {
+	Start, Length int64
+}
+
+// ContentRange returns the Content-Range value of r within content of size bytes.
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a Range header value against content of size bytes.
+// Ranges past the end are dropped, and ErrUnsatisfiableRange returned if none
+// are left. It returns nil and no error when the header is to be ignored:
+// another range unit, a syntax error, too many ranges, or ranges adding up
+// to more than the content, which only make the server work harder.
+// RFC 9110 14.1.1
+func ParseRange(s string, size int64) ([]ByteRange, error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, nil
+	}
+
+	specs := strings.Split(set, ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+	var ranges []ByteRange
+	for _, spec := range specs {
+		spec = strings.Trim(spec, " \t")
+		if spec == "" {
+			continue // empty list elements are allowed. RFC 9110 5.6.1
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+
+		if first == "" { // suffix range, the last bytes
+			n, ok := parseRangeInt(last)
+			if !ok {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, ByteRange{Start: size - n, Length: n})
+			continue
+		}
+
+		start, ok := parseRangeInt(first)
+		if !ok {
+			return nil, nil
+		}
+		end := size - 1
+		if last != "" {
+			if end, ok = parseRangeInt(last); !ok || end < start {
+				return nil, nil
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, ByteRange{Start: start, Length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiableRange
+	}
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, bool) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// ServeContent replies to req with content, streamed from it rather than read
+// into memory. Conditional requests are answered with 304 Not Modified or
+// 412 Precondition Failed by CheckPreconditions. A GET with a Range header
+// gets the ranges asked for: 206 with Content-Range for one,
+// multipart/byteranges for several, and 416 when none can be satisfied.
+// If-Range sends the whole content instead when it does not match the ETag
+// in h or modtime.
+//
+// The Content-Type comes from the extension of name unless h sets one.
+// h holds any further headers to send, and may be nil. A zero modtime
+// sends no Last-Modified.
+func ServeContent(w *Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker, h *headers.Headers) error {
+	if h == nil {
+		h = headers.NewHeaders()
+	} else {
+		h = h.Clone()
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	contentType, hasContentType := h.Get("Content-Type")
+	if !hasContentType {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h.Set("Content-Type", contentType)
+	}
+	if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(headers.TimeFormat))
+	}
+	h.Set("Accept-Ranges", "bytes")
+
+	if done, err := CheckPreconditions(w, req, h, modtime); done || err != nil {
+		return err
+	}
+
+	var ranges []ByteRange
+	if rangeHeader, ok := req.Headers.Get("Range"); ok && req.RequestLine.Method == "GET" && ifRangeMatches(req, h, modtime) {
+		ranges, err = ParseRange(rangeHeader, size)
+		if errors.Is(err, ErrUnsatisfiableRange) {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			h.Set("Content-Length", "0")
+			h.Del("Content-Type")
+			if err := w.WriteStatusLine(StatusRangeNotSatisfiable); err != nil {
+				return err
+			}
+			if err := w.WriteHeaders(h); err != nil {
+				return err
+			}
+			return w.Finish()
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		if req.RequestLine.Method == "HEAD" {
+			// the headers are all there is, no need to read the content
+			return w.Finish()
+		}
+		return copyRange(w, content, ByteRange{Start: 0, Length: size})
+
+	case 1:
+		h.Set("Content-Range", ranges[0].ContentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		if err := w.WriteStatusLine(StatusPartialContent); err != nil {
+			return err
+		}
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		return copyRange(w, content, ranges[0])
+
+	default:
+		return serveMultipartRanges(w, h, content, contentType, size, ranges)
+	}
+}
+
+// serveMultipartRanges sends ranges as a multipart/byteranges body, each part
+// with its own Content-Type and Content-Range. RFC 9110 14.6
+func serveMultipartRanges(w *Writer, h *headers.Headers, content io.ReadSeeker, contentType string, size int64, ranges []ByteRange) error {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return err
+	}
+
+	// the part headers are known up front, which gives the Content-Length
+	partHeaders := make([]string, len(ranges))
+	length := int64(len("\r\n--" + boundary + "--\r\n"))
+	for i, r := range ranges {
+		delim := "\r\n--" + boundary + "\r\n"
+		if i == 0 {
+			delim = "--" + boundary + "\r\n"
+		}
+		partHeaders[i] = delim +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Range: " + r.ContentRange(size) + "\r\n\r\n"
+		length += int64(len(partHeaders[i])) + r.Length
+	}
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if err := w.WriteStatusLine(StatusPartialContent); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	for i, r := range ranges {
+		if _, err := io.WriteString(w, partHeaders[i]); err != nil {
+			return err
+		}
+		if err := copyRange(w, content, r); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "\r\n--"+boundary+"--\r\n")
+	return err
+}
+
+// copyRange writes the bytes of r from content to w.
+func copyRange(w *Writer, content io.ReadSeeker, r ByteRange) error {
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, content, r.Length)
+	return err
+}
+
+// ifRangeMatches reports whether the Range header applies: there is no
+// If-Range, or it matches the current representation. An entity tag matches
+// the ETag in h by strong comparison, a date matches modtime exactly. RFC 9110 13.1.5
+func ifRangeMatches(req *request.Request, h *headers.Headers, modtime time.Time) bool {
+	ifRange, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag, _ := h.Get("ETag")
+		return strongMatch(ifRange, etag)
+	}
+	t, err := headers.ParseTime(ifRange)
+	return err == nil && !modtime.IsZero() && t.Equal(modtime.UTC().Truncate(time.Second))
+}
+
+func randomBoundary() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,26 @@
+package response
+
+import "errors"
+
+var (
+	// ErrInvalidStatusLine is returned for a status code outside 100 to 999,
+	// or a reason phrase holding CR, LF or another control character.
+	ErrInvalidStatusLine = errors.New("invalid status line")
+	// ErrWriterState is returned for a call made out of order,
+	// such as WriteHeaders before WriteStatusLine.
+	ErrWriterState = errors.New("response written out of order")
+	// ErrResponseDone is returned for any write after the response has been finished.
+	ErrResponseDone = errors.New("response already finished")
+	// ErrBodyNotAllowed is returned for a body written to a response that
+	// cannot have one: 1xx, 204 No Content and 304 Not Modified. RFC 9110 6.4.1
+	ErrBodyNotAllowed = errors.New("response status does not allow a body")
+	// ErrContentLength is returned when the body is longer, or
+	// finishes shorter, than the Content-Length header says.
+	ErrContentLength = errors.New("body length does not match Content-Length")
+	// ErrNotChunked is returned for chunked writes to a response
+	// whose body is framed by Content-Length.
+	ErrNotChunked = errors.New("response is not chunked")
+	// ErrMalformedStatusLine is returned by the Parser for a status-line that
+	// does not follow the "HTTP-version SP status-code SP reason-phrase" grammar.
+	ErrMalformedStatusLine = errors.New("malformed status-line")
+)
@@ -0,0 +1,232 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+)
+
+// Response is a response read from a server.
+type Response struct {
+	StatusLine StatusLine
+	Headers    *headers.Headers
+
+	// Interim holds the 1xx responses that came before this one, in order.
+	// They have a status line and headers only.
+	Interim []*Response
+
+	// Body streams the message body from the connection, decoding any
+	// transfer coding along the way. It is never nil. After 101 Switching
+	// Protocols it is the rest of the connection, in the new protocol.
+	Body io.ReadCloser
+
+	// ContentLength is the value of the Content-Length header, or -1 if the
+	// length is not known up front.
+	ContentLength int64
+
+	// Trailers is populated once a chunked Body has been read to EOF.
+	Trailers *headers.Headers
+
+	closeDelimited bool
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// ResponseFromReader parses a response to a GET request from reader. The body
+// is not read up front; it is streamed from reader through Body. Use a Parser
+// for the response to a HEAD request, which has no body, or for the next
+// response on the same connection.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return NewParser(reader).Next("GET")
+}
+
+// Parser reads consecutive responses from a single connection, the way
+// request.Parser reads requests.
+type Parser struct {
+	// Limits applies to every response parsed after it is set. The status
+	// line is held to MaxRequestLineBytes.
+	Limits request.Limits
+	// ObsFold is how folded header and trailer lines are handled. They are rejected by default.
+	ObsFold headers.ObsFold
+
+	msg *request.MessageReader
+}
+
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{msg: request.NewMessageReader(reader)}
+}
+
+// Next parses the response to a request with the given method. 1xx interim
+// responses are collected in Interim on the way to the final one. Whatever
+// the caller left unread of the previous response's body is discarded first.
+// Next returns io.EOF if the connection is closed before a response begins.
+func (p *Parser) Next(method string) (*Response, error) {
+	p.msg.Limits = p.Limits
+	p.msg.ObsFold = p.ObsFold
+	maxLine := p.Limits.MaxRequestLineBytes
+	if maxLine <= 0 {
+		maxLine = request.DefaultMaxRequestLineBytes
+	}
+
+	var interim []*Response
+	for {
+		line, err := p.msg.ReadLine(maxLine)
+		if err != nil {
+			if len(interim) > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		statusLine, err := parseStatusLine(line)
+		if err != nil {
+			return nil, err
+		}
+		resp := &Response{
+			StatusLine: *statusLine,
+			Headers:    headers.NewHeaders(),
+			Trailers:   headers.NewHeaders(),
+			Body:       request.NoBody,
+		}
+		if err := p.msg.ReadHeaders(resp.Headers); err != nil {
+			return nil, err
+		}
+
+		if resp.StatusLine.StatusCode.IsInformational() && resp.StatusLine.StatusCode != StatusSwitchingProtocols {
+			interim = append(interim, resp)
+			continue
+		}
+		resp.Interim = interim
+		if err := p.setBody(resp, method); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// setBody picks the body framing of a response. RFC 9112 6.3
+func (p *Parser) setBody(resp *Response, method string) error {
+	code := resp.StatusLine.StatusCode
+	te, hasTE := resp.Headers.Get("Transfer-Encoding")
+	cl, hasCL := resp.Headers.Get("Content-Length")
+	resp.ContentLength = -1
+
+	switch {
+	case code == StatusSwitchingProtocols:
+		// the connection now speaks whatever was switched to
+		resp.closeDelimited = true
+		resp.Body = p.msg.CloseDelimitedBody()
+		return nil
+	case method == "HEAD" || code == StatusNoContent || code == StatusNotModified,
+		method == "CONNECT" && code >= 200 && code < 300:
+		// Content-Length, if any, is that of the response to a GET
+		if hasCL && !hasTE {
+			if n, err := request.ParseContentLength(cl); err == nil {
+				resp.ContentLength = n
+			}
+		}
+		return nil
+	case hasTE:
+		// Transfer-Encoding overrides Content-Length, but a server sending
+		// both is not to be trusted with the connection afterwards
+		if hasCL {
+			resp.closeDelimited = true
+		}
+		if isChunked(te) {
+			resp.Body = p.msg.ChunkedBody(resp.Trailers)
+		} else {
+			resp.closeDelimited = true
+			resp.Body = p.msg.CloseDelimitedBody()
+		}
+		return nil
+	case hasCL:
+		n, err := request.ParseContentLength(cl)
+		if err != nil {
+			return err
+		}
+		resp.ContentLength = n
+		resp.Body = p.msg.ContentLengthBody(n)
+		return nil
+	default:
+		resp.closeDelimited = true
+		resp.Body = p.msg.CloseDelimitedBody()
+		return nil
+	}
+}
+
+// isChunked reports whether chunked is the final transfer coding of te.
+func isChunked(te string) bool {
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.Trim(codings[len(codings)-1], " \t"), "chunked")
+}
+
+// parseStatusLine parses a status line. The reason phrase may be empty, and
+// the space before it missing, as some servers leave it out. RFC 9112 4
+//
+//	status-line = HTTP-version SP status-code SP [ reason-phrase ]
+func parseStatusLine(line string) (*StatusLine, error) {
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("%w: bare CR or LF", ErrMalformedStatusLine)
+	}
+
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrMalformedStatusLine, line)
+	}
+	major, minor, ok := strings.Cut(strings.TrimPrefix(version, "HTTP/"), ".")
+	if !strings.HasPrefix(version, "HTTP/") || !ok || len(major) != 1 || len(minor) != 1 ||
+		!isDigit(major[0]) || !isDigit(minor[0]) {
+		return nil, fmt.Errorf("%w: unrecognized HTTP-version: %q", ErrMalformedStatusLine, version)
+	}
+	if major != "1" {
+		return nil, fmt.Errorf("%w: unsupported HTTP-version: %q", ErrMalformedStatusLine, version)
+	}
+
+	codeText, reason, _ := strings.Cut(rest, " ")
+	if len(codeText) != 3 || !isDigit(codeText[0]) || !isDigit(codeText[1]) || !isDigit(codeText[2]) {
+		return nil, fmt.Errorf("%w: invalid status code: %q", ErrMalformedStatusLine, codeText)
+	}
+	code, _ := strconv.Atoi(codeText)
+	if code < 100 {
+		return nil, fmt.Errorf("%w: invalid status code: %q", ErrMalformedStatusLine, codeText)
+	}
+
+	return &StatusLine{
+		HttpVersion:  major + "." + minor,
+		StatusCode:   StatusCode(code),
+		ReasonPhrase: reason,
+	}, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// KeepAlive reports whether the connection can carry another request after
+// this response has been read. It cannot when the body ends with the
+// connection, or the server says it will close it. RFC 9112 9.3
+func (r *Response) KeepAlive() bool {
+	if r.closeDelimited {
+		return false
+	}
+	connection, _ := r.Headers.Get("Connection")
+	keepAlive := r.StatusLine.HttpVersion != "1.0"
+	for _, option := range strings.Split(connection, ",") {
+		option = strings.TrimSpace(option)
+		if strings.EqualFold(option, "close") {
+			return false
+		}
+		if strings.EqualFold(option, "keep-alive") {
+			keepAlive = true
+		}
+	}
+	return keepAlive
+}
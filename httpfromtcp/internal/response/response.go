@@ -1,9 +1,12 @@
 package response
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/livingpool/httpfromtcp/internal/headers"
 )
@@ -11,138 +14,592 @@ import (
 type StatusCode int
 type writerState int
 
-const (
-	StatusOK            = StatusCode(200)
-	StatusBadRequest    = StatusCode(400)
-	StatusInternalError = StatusCode(500)
-)
-
 const (
 	writingStatusLine writerState = iota
 	writingHeaders
 	writingBody
+	writingTrailers
 	writingDone
 )
 
+// maxBufferedBody is how much of the body is held back before the headers go
+// out. A body that is finished within it gets a Content-Length, a longer one
+// is sent chunked.
+const maxBufferedBody = 4 << 10
+
+// Writer writes a single response. A handler calls WriteStatusLine,
+// WriteHeaders and then writes the body, or just writes the body, in which
+// case the status is 200 with default headers. The status line and headers
+// are held back until the first body bytes go out, so that the framing can be
+// filled in: Content-Length when the whole body is known by then, chunked
+// otherwise. A Date header is added when missing.
+//
+// Calls out of order fail with ErrWriterState, and any write after the
+// response is finished with ErrResponseDone.
 type Writer struct {
 	stream      io.Writer
 	writerState writerState
+	version     string
+
+	// closeAfter is set when the connection must be closed after this response
+	closeAfter bool
+	// framed is set when the headers tell the client where the body ends
+	framed bool
+	// interim is set while writing a 1xx response, which another status line follows
+	interim bool
+	// status and reason are the final status line, sent with the headers
+	status StatusCode
+	reason string
+	// header holds the final headers until they are sent
+	header *headers.Headers
+	// headerSent is set once the status line and headers are on the wire
+	headerSent bool
+	// buf holds body bytes written before the headers were sent
+	buf []byte
+	// chunked is set when the body is sent with the chunked transfer coding
+	chunked bool
+	// contentLength is the Content-Length sent, -1 if there was none
+	contentLength int64
+	// bodyWritten counts the body bytes passed to the stream
+	bodyWritten int64
+	// omitBody is set for the response to a HEAD request, which has no body
+	omitBody bool
+	// headerHooks run before the final headers are sent, finishHooks once the response is done
+	headerHooks []func(StatusCode, *headers.Headers)
+	finishHooks []func()
+
+	now func() time.Time
 }
 
 func NewResponseWriter(stream io.Writer) *Writer {
 	return &Writer{
-		stream:      stream,
-		writerState: writingStatusLine,
+		stream:        stream,
+		writerState:   writingStatusLine,
+		version:       "1.1",
+		contentLength: -1,
+		now:           time.Now,
 	}
 }
 
+// Write writes body bytes. A Write before WriteStatusLine sends status 200
+// with the default headers, one before WriteHeaders sends the default headers.
+// A chunked body is encoded as it goes.
 func (w *Writer) Write(p []byte) (int, error) {
-	n, err := w.stream.Write(p)
-	return n, err
+	if err := w.startBody("Write"); err != nil {
+		return 0, err
+	}
+	return w.writeBody(p)
 }
 
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	if w.writerState != writingStatusLine {
-		return fmt.Errorf("state is not writingStatusLine")
+// startBody gets the writer ready for body writes, filling in the
+// status line and headers the handler did not write.
+func (w *Writer) startBody(call string) error {
+	if w.interim {
+		return fmt.Errorf("%w: %s during a 1xx response", ErrWriterState, call)
 	}
+	switch w.writerState {
+	case writingStatusLine:
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+		fallthrough
+	case writingHeaders:
+		return w.WriteHeaders(defaultHeaders(w.status))
+	case writingBody:
+		return nil
+	case writingTrailers:
+		return fmt.Errorf("%w: %s after WriteChunkedBodyDone", ErrWriterState, call)
+	default:
+		return ErrResponseDone
+	}
+}
 
-	reasonPhrase := ""
+// WriteStatusLine writes the status line with the standard reason phrase of statusCode.
+// A 1xx interim response other than 101 Switching Protocols is finished by
+// WriteHeaders as usual, after which another status line can be written:
+// more 1xx responses, then the final one.
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineReason(statusCode, StatusText(statusCode))
+}
 
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusInternalError:
-		reasonPhrase = "Internal Server Error"
+// WriteStatusLineReason is like WriteStatusLine with a custom reason phrase,
+// which may be empty. RFC 9112 4
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reason string) error {
+	if err := w.checkState(writingStatusLine, "WriteStatusLine"); err != nil {
+		return err
+	}
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("%w: status code %d", ErrInvalidStatusLine, statusCode)
+	}
+	if !validReasonPhrase(reason) {
+		return fmt.Errorf("%w: reason phrase %q", ErrInvalidStatusLine, reason)
 	}
 
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
-	_, err := w.Write([]byte(statusLine))
-	if err != nil {
-		return err
+	interim := statusCode.IsInformational() && statusCode != StatusSwitchingProtocols
+	if interim {
+		if w.version == "1.0" {
+			// HTTP/1.0 has no interim responses, the client would take it for the final one. RFC 9110 15.2
+			return fmt.Errorf("%w: cannot send %d to an HTTP/1.0 client", ErrWriterState, statusCode)
+		}
+		// interim responses go out right away, that is their point
+		statusLine := fmt.Sprintf("HTTP/%s %d %s\r\n", w.version, statusCode, reason)
+		if _, err := io.WriteString(w.stream, statusLine); err != nil {
+			return err
+		}
 	}
 
+	w.interim = interim
+	w.status = statusCode
+	w.reason = reason
 	w.writerState = writingHeaders
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if w.writerState != writingHeaders {
-		return fmt.Errorf("state is not writingHeaders")
+// validReasonPhrase reports whether reason holds only HTAB, SP, visible
+// characters and obs-text.
+func validReasonPhrase(reason string) bool {
+	for i := 0; i < len(reason); i++ {
+		if c := reason[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteHeaders sets the headers of the response. Those of a 1xx response are
+// sent right away, the final ones with the first body bytes or when the
+// response is finished. h is copied, later changes to it are not sent.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if err := w.checkState(writingHeaders, "WriteHeaders"); err != nil {
+		return err
 	}
 
-	for k, v := range headers {
-		fieldLine := fmt.Sprintf("%s: %s\r\n", k, v)
-		_, err := w.Write([]byte(fieldLine))
-		if err != nil {
+	if w.interim {
+		// an interim response has no body, the next status line follows
+		var buf bytes.Buffer
+		h.WriteTo(&buf)
+		buf.WriteString("\r\n")
+		if _, err := buf.WriteTo(w.stream); err != nil {
 			return err
 		}
+		w.interim = false
+		w.writerState = writingStatusLine
+		return nil
 	}
 
+	w.header = h.Clone()
 	w.writerState = writingBody
-	_, err := w.Write([]byte("\r\n"))
-	return err
+	if w.status == StatusSwitchingProtocols {
+		// the connection speaks another protocol from here on, the handler owns it
+		return w.sendHeader(false)
+	}
+	return nil
 }
 
+// WriteBody writes body like Write, as the rest of the body, and finishes the
+// response. When it is the only body write, its length becomes the Content-Length.
 func (w *Writer) WriteBody(body []byte) (int, error) {
-	if w.writerState != writingBody {
-		return 0, fmt.Errorf("state is not writingBody")
-	}
-
-	w.writerState = writingDone
 	n, err := w.Write(body)
-	return n, err
+	if err != nil {
+		return n, err
+	}
+	return n, w.Finish()
 }
 
+// WriteChunkedBody writes p as a single chunk, sending the headers first if
+// they have not been. A response without framing headers becomes chunked.
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	if w.writerState != writingBody {
-		return 0, fmt.Errorf("state is not writingBody")
+	if err := w.startBody("WriteChunkedBody"); err != nil {
+		return 0, err
+	}
+	if !w.headerSent {
+		if err := w.sendHeader(false); err != nil {
+			return 0, err
+		}
+	}
+	if !w.chunked && w.framed {
+		return 0, ErrNotChunked
 	}
+	return w.writeBody(p)
+}
 
-	totalBytesWritten := 0
+// WriteChunkedBodyDone writes the last chunk. Trailers may follow with
+// WriteTrailers, otherwise Finish ends the response.
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if err := w.startBody("WriteChunkedBodyDone"); err != nil {
+		return 0, err
+	}
+	if !w.headerSent {
+		if err := w.sendHeader(false); err != nil {
+			return 0, err
+		}
+	}
+	if !w.chunked && w.framed {
+		return 0, ErrNotChunked
+	}
 
-	chunkLen := fmt.Sprintf("%x", len(p)) + "\r\n"
-	n, err := w.Write([]byte(chunkLen))
-	totalBytesWritten += n
-	if err != nil {
-		return totalBytesWritten, err
+	w.writerState = writingTrailers
+	if !w.chunked || w.omitBody { // HTTP/1.0, the body just ends
+		return 0, nil
 	}
-	n, err = w.Write(p)
-	totalBytesWritten += n
-	if err != nil {
-		return totalBytesWritten, err
+	return io.WriteString(w.stream, "0\r\n")
+}
+
+// WriteTrailers writes the trailer section after WriteChunkedBodyDone and
+// finishes the response. Trailers are dropped for HTTP/1.0 clients, which
+// do not get a chunked body to carry them.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if err := w.checkState(writingTrailers, "WriteTrailers"); err != nil {
+		return err
 	}
 
-	n, err = w.Write([]byte("\r\n"))
-	totalBytesWritten += n
-	if err != nil {
-		return totalBytesWritten, err
+	w.writerState = writingDone
+	if !w.chunked || w.omitBody {
+		return nil
 	}
+	var buf bytes.Buffer
+	h.WriteTo(&buf)
+	buf.WriteString("\r\n")
+	_, err := buf.WriteTo(w.stream)
+	return err
+}
 
-	return totalBytesWritten, nil
+// Finish completes the response: it sends status 200 if nothing was written,
+// the headers if they are still held back, the end of a chunked body, and
+// reports a body shorter than its Content-Length, after which the connection
+// cannot be reused. The server calls it once the handler returns; calling it
+// again does nothing.
+func (w *Writer) Finish() error {
+	err := w.finish()
+	w.runFinishHooks()
+	return err
 }
 
-func (w *Writer) WriteChunkedBodyDone() (int, error) {
+func (w *Writer) finish() error {
+	switch w.writerState {
+	case writingStatusLine, writingHeaders:
+		if err := w.startBody("Finish"); err != nil {
+			return err
+		}
+		fallthrough
+	case writingBody:
+		if !w.headerSent {
+			if err := w.sendHeader(true); err != nil {
+				return err
+			}
+		}
+		w.writerState = writingDone
+		if w.omitBody {
+			return nil
+		}
+		if w.chunked {
+			_, err := io.WriteString(w.stream, "0\r\n\r\n")
+			return err
+		}
+		if w.contentLength >= 0 && w.bodyWritten < w.contentLength && bodyAllowed(w.status) {
+			w.closeAfter = true // the client is still waiting for the rest
+			return fmt.Errorf("%w: wrote %d of %d bytes", ErrContentLength, w.bodyWritten, w.contentLength)
+		}
+		return nil
+	case writingTrailers:
+		w.writerState = writingDone
+		if !w.chunked || w.omitBody {
+			return nil
+		}
+		_, err := io.WriteString(w.stream, "\r\n")
+		return err
+	default:
+		return nil
+	}
+}
+
+// Abort breaks the response off where it is, for a handler that cannot
+// produce the rest of the body. Nothing more is written, not even the end of
+// a chunked body, and the connection is closed, so that the client can tell
+// the response is incomplete.
+func (w *Writer) Abort() {
+	w.closeAfter = true
 	w.writerState = writingDone
-	n, err := w.Write([]byte("0\r\n"))
-	return n, err
+	w.runFinishHooks()
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-	w.writerState = writingHeaders
-	return w.WriteHeaders(h)
+// OnHeader registers f to be called with the final status and headers just
+// before they are sent, for middleware adding headers whatever the handler
+// writes. f may change h. Hooks run in the order they were registered.
+func (w *Writer) OnHeader(f func(StatusCode, *headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, f)
+}
+
+// OnFinish registers f to be called once the response is finished or
+// aborted, when Status and BytesWritten have their final values. Hooks run in
+// the reverse order they were registered, like deferred calls.
+func (w *Writer) OnFinish(f func()) {
+	w.finishHooks = append(w.finishHooks, f)
+}
+
+func (w *Writer) runFinishHooks() {
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// writeBody writes p to the body, holding it back while the
+// headers have not been sent and it fits in the buffer.
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !bodyAllowed(w.status) {
+		return 0, fmt.Errorf("%w: %d", ErrBodyNotAllowed, w.status)
+	}
+
+	if !w.headerSent {
+		if len(w.buf)+len(p) <= maxBufferedBody {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		if err := w.sendHeader(false); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.contentLength >= 0 && w.bodyWritten+int64(len(p)) > w.contentLength {
+		return 0, fmt.Errorf("%w: %d bytes more than %d", ErrContentLength, w.bodyWritten+int64(len(p))-w.contentLength, w.contentLength)
+	}
+	w.bodyWritten += int64(len(p))
+	if w.omitBody {
+		return len(p), nil
+	}
+	if !w.chunked {
+		return w.stream.Write(p)
+	}
+
+	chunk := make([]byte, 0, len(p)+20)
+	chunk = strconv.AppendInt(chunk, int64(len(p)), 16)
+	chunk = append(chunk, "\r\n"...)
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+	if _, err := w.stream.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sendHeader sends the status line and headers, followed by the buffered
+// body. complete tells whether the buffer holds the whole body, in which
+// case it sets the Content-Length.
+func (w *Writer) sendHeader(complete bool) error {
+	h := w.header
+	w.headerSent = true
+	for _, f := range w.headerHooks {
+		f(w.status, h)
+	}
+
+	if _, hasDate := h.Get("Date"); !hasDate {
+		h.Set("Date", w.now().UTC().Format(headers.TimeFormat))
+	}
+
+	if w.status == StatusSwitchingProtocols {
+		w.closeAfter = true
+		w.framed = true
+		return w.writeHeader(h)
+	}
+
+	te, hasTransferEncoding := h.Get("Transfer-Encoding")
+	switch {
+	case !bodyAllowed(w.status):
+		w.framed = true
+		h.Del("Transfer-Encoding")
+		if w.status == StatusNoContent {
+			h.Del("Content-Length") // RFC 9110 8.6
+		}
+	case hasTransferEncoding && w.version == "1.0":
+		// HTTP/1.0 clients do not know transfer codings, to them the body ends when the connection does
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+		h.Del("Content-Length")
+	case hasTransferEncoding:
+		h.Del("Content-Length") // RFC 9112 6.2
+		w.chunked = strings.HasSuffix(strings.ToLower(strings.TrimSpace(te)), "chunked")
+		w.framed = w.chunked
+	case hasContentLength(h):
+		cl, _ := h.Get("Content-Length")
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: invalid Content-Length %q", ErrContentLength, cl)
+		}
+		if int64(len(w.buf)) > n {
+			return fmt.Errorf("%w: %d bytes more than %d", ErrContentLength, int64(len(w.buf))-n, n)
+		}
+		w.contentLength = n
+		w.framed = true
+	case complete:
+		h.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		w.contentLength = int64(len(w.buf))
+		w.framed = true
+	case w.version != "1.0":
+		h.Set("Transfer-Encoding", "chunked")
+		w.chunked = true
+		w.framed = true
+	}
+
+	if err := w.writeHeader(h); err != nil {
+		return err
+	}
+
+	buf := w.buf
+	w.buf = nil
+	_, err := w.writeBody(buf)
+	return err
+}
+
+// writeHeader writes the status line and h, adding the Connection header the
+// framing and the client's version call for.
+func (w *Writer) writeHeader(h *headers.Headers) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/%s %d %s\r\n", w.version, w.status, w.reason)
+	h.WriteTo(&buf)
+
+	_, hasConnection := h.Get("Connection")
+	switch {
+	case hasCloseOption(h):
+		w.closeAfter = true
+	case w.status == StatusSwitchingProtocols:
+	case w.closeAfter || !w.framed && !w.omitBody:
+		w.closeAfter = true
+		buf.WriteString("Connection: close\r\n")
+	case w.version == "1.0" && !hasConnection:
+		// an HTTP/1.0 connection only persists if the server confirms it
+		buf.WriteString("Connection: keep-alive\r\n")
+	}
+
+	buf.WriteString("\r\n")
+	_, err := buf.WriteTo(w.stream)
+	return err
+}
+
+// checkState returns an error describing the call out of order
+// if the writer is not in the state want.
+func (w *Writer) checkState(want writerState, call string) error {
+	switch {
+	case w.writerState == want:
+		return nil
+	case w.writerState == writingDone:
+		return ErrResponseDone
+	case w.writerState > want:
+		return fmt.Errorf("%w: %s called twice or too late", ErrWriterState, call)
+	case want == writingHeaders:
+		return fmt.Errorf("%w: %s called before WriteStatusLine", ErrWriterState, call)
+	case want == writingTrailers:
+		return fmt.Errorf("%w: %s called before WriteChunkedBodyDone", ErrWriterState, call)
+	default:
+		return fmt.Errorf("%w: %s called before WriteHeaders", ErrWriterState, call)
+	}
+}
+
+// bodyAllowed reports whether a response with status code can have a body. RFC 9110 6.4.1
+// What follows a 101 is not a body, but it is up to the handler to write it.
+func bodyAllowed(code StatusCode) bool {
+	return code == StatusSwitchingProtocols ||
+		!code.IsInformational() && code != StatusNoContent && code != StatusNotModified
+}
+
+func hasContentLength(h *headers.Headers) bool {
+	_, ok := h.Get("Content-Length")
+	return ok
+}
+
+// WriteContinue sends a 100 Continue interim response, telling a client
+// that sent "Expect: 100-continue" to go ahead with the body. It does
+// nothing once the final response has been started.
+func (w *Writer) WriteContinue() error {
+	if w.writerState != writingStatusLine {
+		return nil
+	}
+	if err := w.WriteStatusLine(StatusContinue); err != nil {
+		return err
+	}
+	return w.WriteHeaders(headers.NewHeaders())
+}
+
+// Written reports whether the final status line has been written.
+func (w *Writer) Written() bool {
+	return w.writerState != writingStatusLine && !w.interim
+}
+
+// Status returns the final status code, or 0 while it has not been written.
+func (w *Writer) Status() StatusCode {
+	if !w.Written() {
+		return 0
+	}
+	return w.status
+}
+
+// BytesWritten returns the number of body bytes sent so far, not counting
+// the chunked framing. It stays 0 for the response to a HEAD request.
+func (w *Writer) BytesWritten() int64 {
+	if w.omitBody {
+		return 0
+	}
+	return w.bodyWritten
+}
+
+// SetVersion sets the HTTP version of the status line, "1.1" by default.
+// The server sets it to match the version of the request.
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+// OmitBody makes this the response to a HEAD request. The status line and
+// headers are those a GET would get, Content-Length included, but the body
+// the handler writes is left out. The server calls it for HEAD requests.
+// RFC 9110 9.3.2
+func (w *Writer) OmitBody() {
+	w.omitBody = true
+}
+
+// CloseAfterResponse marks the connection to be closed once this response is
+// written. A "Connection: close" header is added if the handler did not set one.
+func (w *Writer) CloseAfterResponse() {
+	w.closeAfter = true
+}
+
+// KeepAlive reports whether the connection can be reused for another
+// request after this response. It cannot if nothing was written, if the
+// body is delimited by closing the connection, or if either side asked for close.
+func (w *Writer) KeepAlive() bool {
+	return w.Written() && !w.closeAfter
+}
+
+func hasCloseOption(h *headers.Headers) bool {
+	connection, _ := h.Get("Connection")
+	for _, option := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultHeaders are the headers of a response whose handler did not write any.
+func defaultHeaders(code StatusCode) *headers.Headers {
+	h := headers.NewHeaders()
+	if bodyAllowed(code) {
+		h.Set("Content-Type", "text/plain")
+	}
+	return h
 }
 
-func GetEmptyHeaders() headers.Headers {
+func GetEmptyHeaders() *headers.Headers {
 	return headers.NewHeaders()
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	headers := headers.NewHeaders()
 
 	headers.Set("Content-Length", strconv.Itoa(contentLen))
-	headers.Set("Connection", "close")
 	headers.Set("Content-Type", "text/plain")
 
 	return headers
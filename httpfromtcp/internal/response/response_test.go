@@ -0,0 +1,1050 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDate = "Date: Sun, 06 Nov 1994 08:49:37 GMT\r\n"
+
+// newTestWriter returns a Writer writing to buf, with a fixed clock.
+func newTestWriter(buf *bytes.Buffer) *Writer {
+	w := NewResponseWriter(buf)
+	w.now = func() time.Time {
+		return time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	}
+	return w
+}
+
+func TestStatusLine(t *testing.T) {
+	// Test: Standard reason phrases
+	for code, line := range map[StatusCode]string{
+		StatusOK:                            "HTTP/1.1 200 OK\r\n",
+		StatusNotFound:                      "HTTP/1.1 404 Not Found\r\n",
+		StatusUnprocessableContent:          "HTTP/1.1 422 Unprocessable Content\r\n",
+		StatusNetworkAuthenticationRequired: "HTTP/1.1 511 Network Authentication Required\r\n",
+	} {
+		var buf bytes.Buffer
+		w := newTestWriter(&buf)
+		require.NoError(t, w.WriteStatusLine(code))
+		require.NoError(t, w.Finish())
+		assert.True(t, strings.HasPrefix(buf.String(), line), buf.String())
+	}
+
+	// Test: Unregistered status code has an empty reason phrase
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(299))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 299 \r\n"))
+	assert.Equal(t, "", StatusText(299))
+
+	// Test: Custom reason phrase
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLineReason(StatusOK, "Totally Fine\tReally"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 Totally Fine\tReally\r\n"))
+
+	// Test: Invalid reason phrase
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.ErrorIs(t, w.WriteStatusLineReason(StatusOK, "OK\r\nSet-Cookie: a=b"), ErrInvalidStatusLine)
+
+	// Test: Invalid status code
+	require.ErrorIs(t, w.WriteStatusLine(42), ErrInvalidStatusLine)
+	require.ErrorIs(t, w.WriteStatusLine(1000), ErrInvalidStatusLine)
+	assert.Empty(t, buf.String())
+}
+
+func TestInformationalResponses(t *testing.T) {
+	// Test: Several 1xx responses before the final one
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteContinue())
+	assert.False(t, w.Written())
+
+	h := headers.NewHeaders()
+	h.Add("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	assert.False(t, w.Written())
+	require.NoError(t, w.WriteHeaders(h))
+	h.Add("Link", "</script.js>; rel=preload; as=script")
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.False(t, w.Written())
+
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err := w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	assert.True(t, w.Written())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\nLink: </script.js>; rel=preload; as=script\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n"+testDate+"\r\nok", buf.String())
+
+	// Test: WriteContinue after the final status line does nothing
+	n := buf.Len()
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, n, buf.Len())
+
+	// Test: No 1xx for HTTP/1.0
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.SetVersion("1.0")
+	require.ErrorIs(t, w.WriteStatusLine(StatusEarlyHints), ErrWriterState)
+	assert.Empty(t, buf.String())
+
+	// Test: No body for a 1xx
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	_, err = w.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrWriterState)
+
+	// Test: 101 Switching Protocols is final and hands over the connection
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusSwitchingProtocols))
+	h = headers.NewHeaders()
+	h.Add("Connection", "upgrade")
+	h.Add("Upgrade", "websocket")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.True(t, w.Written())
+	require.ErrorIs(t, w.WriteStatusLine(StatusOK), ErrWriterState)
+	_, err = w.Write([]byte("\x81\x00"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: websocket\r\n"+testDate+"\r\n\x81\x00", buf.String())
+}
+
+func TestWriterFraming(t *testing.T) {
+	// Test: Implicit status and headers on the first Write
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	_, err := w.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String()) // held back
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Content-Length: 11\r\n\r\nhello world", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Nothing written at all
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Content-Length: 0\r\n\r\n", buf.String())
+
+	// Test: Content-Length from WriteBody
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	require.NoError(t, w.WriteHeaders(h))
+	h.Set("X-Too-Late", "1")
+	_, err = w.WriteBody([]byte("<p>gone</p>"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Type: text/html\r\n"+testDate+"Content-Length: 11\r\n\r\n<p>gone</p>", buf.String())
+
+	// Test: Large body goes out chunked
+	buf.Reset()
+	w = newTestWriter(&buf)
+	big := strings.Repeat("a", maxBufferedBody)
+	_, err = w.Write([]byte(big))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n"+
+		"1000\r\n"+big+"\r\n1\r\nb\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Large body to an HTTP/1.0 client is delimited by closing
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.SetVersion("1.0")
+	_, err = w.Write([]byte(big + "b"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Connection: close\r\n\r\n"+big+"b", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Handler's own Date is kept
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = GetDefaultHeaders(0)
+	h.Set("Date", "Mon, 01 Jan 2024 00:00:00 GMT")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\nDate: Mon, 01 Jan 2024 00:00:00 GMT\r\n\r\n", buf.String())
+
+	// Test: No body and no Content-Length for 204
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+	_, err = w.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterContentLength(t *testing.T) {
+	// Test: Body longer than Content-Length
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err := w.Write([]byte("abcd"))
+	require.NoError(t, err) // still held back
+	require.ErrorIs(t, w.Finish(), ErrContentLength)
+
+	// Test: Body longer than Content-Length after the headers went out
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(maxBufferedBody+1)))
+	_, err = w.Write([]byte(strings.Repeat("a", maxBufferedBody+1)))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("a"))
+	require.ErrorIs(t, err, ErrContentLength)
+	require.NoError(t, w.Finish())
+
+	// Test: Body shorter than Content-Length closes the connection
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.ErrorIs(t, w.Finish(), ErrContentLength)
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nContent-Type: text/plain\r\n"+testDate+"\r\nabc", buf.String())
+}
+
+func TestWriterChunked(t *testing.T) {
+	// Test: Chunks and trailers
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody(nil) // would end the body if it were sent
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrWriterState)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n"+testDate+"\r\n"+
+		"5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n", buf.String())
+
+	// Test: Last chunk without trailers still ends the message
+	buf.Reset()
+	w = newTestWriter(&buf)
+	_, err = w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n"+
+		"2\r\nhi\r\n0\r\n\r\n", buf.String())
+
+	// Test: HTTP/1.0 gets the plain body and no trailers
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n"+testDate+"Connection: close\r\n\r\nhello", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Chunks on a Content-Length response
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrNotChunked)
+}
+
+func TestWriterOmitBody(t *testing.T) {
+	// Test: Headers of the GET response, body left out
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	w.OmitBody()
+	_, err := w.WriteBody([]byte("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Content-Length: 11\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Declared Content-Length without writing the body
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.OmitBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(100)))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nContent-Type: text/plain\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked response has no chunks, last chunk or trailers
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.OmitBody()
+	_, err = w.WriteChunkedBody([]byte("hi"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Large body is counted, not sent
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.OmitBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(maxBufferedBody+1)))
+	_, err = w.Write([]byte(strings.Repeat("a", maxBufferedBody+1)))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("a"))
+	require.ErrorIs(t, err, ErrContentLength)
+	assert.NotContains(t, buf.String(), "aaa")
+}
+
+func TestWriterHooks(t *testing.T) {
+	// Test: Header hooks change the headers, finish hooks see the outcome
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	var order []string
+	w.OnHeader(func(code StatusCode, h *headers.Headers) {
+		assert.Equal(t, StatusNotFound, code)
+		h.Set("X-First", "1")
+		order = append(order, "header 1")
+	})
+	w.OnHeader(func(_ StatusCode, h *headers.Headers) {
+		h.Set("X-Second", "2")
+		order = append(order, "header 2")
+	})
+	w.OnFinish(func() {
+		assert.Equal(t, StatusNotFound, w.Status())
+		assert.Equal(t, int64(4), w.BytesWritten())
+		order = append(order, "finish 1")
+	})
+	w.OnFinish(func() { order = append(order, "finish 2") })
+	assert.Equal(t, StatusCode(0), w.Status())
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.NoError(t, w.WriteHeaders(GetEmptyHeaders()))
+	_, err := w.Write([]byte("gone"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), w.BytesWritten()) // still held back
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []string{"header 1", "header 2", "finish 2", "finish 1"}, order)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nX-First: 1\r\nX-Second: 2\r\n"+testDate+"Content-Length: 4\r\n\r\ngone", buf.String())
+
+	// Test: Not the headers of an interim response
+	buf.Reset()
+	w = newTestWriter(&buf)
+	calls := 0
+	w.OnHeader(func(StatusCode, *headers.Headers) { calls++ })
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, 0, calls)
+	assert.Equal(t, StatusCode(0), w.Status())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, StatusOK, w.Status())
+
+	// Test: Abort runs the finish hooks once
+	buf.Reset()
+	w = newTestWriter(&buf)
+	calls = 0
+	w.OnFinish(func() { calls++ })
+	w.Abort()
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, calls)
+
+	// Test: No body bytes for HEAD
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.OmitBody()
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), w.BytesWritten())
+}
+
+func TestWriterMisuse(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Test: Headers before the status line
+	w := newTestWriter(&buf)
+	require.ErrorIs(t, w.WriteHeaders(headers.NewHeaders()), ErrWriterState)
+
+	// Test: Status line twice
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.ErrorIs(t, w.WriteStatusLine(StatusOK), ErrWriterState)
+
+	// Test: Trailers before the last chunk
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.ErrorIs(t, w.WriteTrailers(headers.NewHeaders()), ErrWriterState)
+
+	// Test: Anything after the response is done
+	_, err := w.WriteBody([]byte("body"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("more"))
+	require.ErrorIs(t, err, ErrResponseDone)
+	_, err = w.WriteBody([]byte("more"))
+	require.ErrorIs(t, err, ErrResponseDone)
+	_, err = w.WriteChunkedBodyDone()
+	require.ErrorIs(t, err, ErrResponseDone)
+	require.ErrorIs(t, w.WriteStatusLine(StatusOK), ErrResponseDone)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nbody"))
+}
+
+func TestChunkedWriter(t *testing.T) {
+	// Test: Small writes coalesce into chunks of the set size
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	cw := NewChunkedWriterSize(w, 4)
+	for _, s := range []string{"a", "bc", "defgh", "ij"} {
+		n, err := cw.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	cw.Trailers = headers.NewHeaders()
+	cw.Trailers.Set("X-Count", "4")
+	require.NoError(t, cw.Close())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n"+
+		"4\r\nabcd\r\n4\r\nefgh\r\n2\r\nij\r\n0\r\nX-Count: 4\r\n\r\n", buf.String())
+	_, err := cw.Write([]byte("late"))
+	require.ErrorIs(t, err, ErrResponseDone)
+	require.NoError(t, cw.Close())
+	require.NoError(t, w.Finish())
+
+	// Test: io.Copy reads straight into chunks
+	buf.Reset()
+	w = newTestWriter(&buf)
+	cw = NewChunkedWriterSize(w, 5)
+	n, err := io.Copy(cw, iotest.OneByteReader(strings.NewReader("hello world")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	require.NoError(t, cw.Close())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n5\r\n worl\r\n1\r\nd\r\n0\r\n\r\n"), buf.String())
+
+	// Test: Flush sends the headers and a partial chunk
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	cw = NewChunkedWriter(w)
+	require.NoError(t, cw.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n", buf.String())
+	_, err = cw.Write([]byte("data: 1\n\n"))
+	require.NoError(t, err)
+	require.NoError(t, cw.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n9\r\ndata: 1\n\n\r\n"))
+	require.NoError(t, cw.Close())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Read error ends the copy
+	buf.Reset()
+	w = newTestWriter(&buf)
+	cw = NewChunkedWriterSize(w, 4)
+	n, err = io.Copy(cw, io.MultiReader(strings.NewReader("abcdef"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, int64(6), n)
+
+	// Test: Abort leaves the body unfinished and closes the connection
+	w.Abort()
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n4\r\nabcd\r\n"), buf.String())
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []ByteRange
+		err   error
+	}{
+		{"first bytes", "bytes=0-499", []ByteRange{{0, 500}}, nil},
+		{"middle bytes", "bytes=500-999", []ByteRange{{500, 500}}, nil},
+		{"open ended", "bytes=9500-", []ByteRange{{9500, 500}}, nil},
+		{"suffix", "bytes=-500", []ByteRange{{9500, 500}}, nil},
+		{"suffix longer than content", "bytes=-20000", []ByteRange{{0, 10000}}, nil},
+		{"last byte past the end", "bytes=9000-20000", []ByteRange{{9000, 1000}}, nil},
+		{"several", "bytes=0-0, -1", []ByteRange{{0, 1}, {9999, 1}}, nil},
+		{"empty elements", "bytes=,0-1,,", []ByteRange{{0, 2}}, nil},
+		{"unit case", "Bytes=0-1", []ByteRange{{0, 2}}, nil},
+		{"unsatisfiable dropped", "bytes=0-1, 20000-", []ByteRange{{0, 2}}, nil},
+		{"all unsatisfiable", "bytes=10000-", nil, ErrUnsatisfiableRange},
+		{"zero suffix", "bytes=-0", nil, ErrUnsatisfiableRange},
+		{"other unit", "items=0-1", nil, nil},
+		{"no equals", "bytes 0-1", nil, nil},
+		{"no dash", "bytes=5", nil, nil},
+		{"last before first", "bytes=5-4", nil, nil},
+		{"negative", "bytes=--5", nil, nil},
+		{"sign", "bytes=+1-2", nil, nil},
+		{"adds up to more than the content", "bytes=0-, 0-", nil, nil},
+		{"too many", "bytes=" + strings.Repeat("0-0,", maxRanges) + "0-0", nil, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseRange(tc.value, 10000)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	modtime := time.Date(2025, time.April, 16, 10, 0, 0, 0, time.UTC)
+
+	serve := func(t *testing.T, reqHeaders string, h *headers.Headers) string {
+		req, err := request.RequestFromReader(strings.NewReader("GET /video HTTP/1.1\r\nHost: localhost\r\n" + reqHeaders + "\r\n"))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		w := newTestWriter(&buf)
+		require.NoError(t, ServeContent(w, req, "notes.txt", modtime, strings.NewReader(content), h))
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+	const validators = "Last-Modified: Wed, 16 Apr 2025 10:00:00 GMT\r\nAccept-Ranges: bytes\r\n"
+
+	// Test: Whole content
+	got := serve(t, "", nil)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\n"+validators+
+		"Content-Length: 20\r\n"+testDate+"\r\n"+content, got)
+
+	// Test: HEAD sends the headers without reading the content
+	req, err := request.RequestFromReader(strings.NewReader("HEAD /video HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	w.OmitBody()
+	src := &readCounter{ReadSeeker: strings.NewReader(content)}
+	require.NoError(t, ServeContent(w, req, "notes.txt", modtime, src, nil))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\n"+validators+
+		"Content-Length: 20\r\n"+testDate+"\r\n", buf.String())
+	assert.Equal(t, 0, src.reads)
+
+	// Test: Single range
+	got = serve(t, "Range: bytes=2-4\r\n", nil)
+	assert.Equal(t, "HTTP/1.1 206 Partial Content\r\nContent-Type: text/plain; charset=utf-8\r\n"+validators+
+		"Content-Range: bytes 2-4/20\r\nContent-Length: 3\r\n"+testDate+"\r\n234", got)
+
+	// Test: Unsatisfiable range
+	got = serve(t, "Range: bytes=20-\r\n", nil)
+	assert.Equal(t, "HTTP/1.1 416 Range Not Satisfiable\r\n"+validators+
+		"Content-Range: bytes */20\r\nContent-Length: 0\r\n"+testDate+"\r\n", got)
+
+	// Test: Ignored range
+	got = serve(t, "Range: lines=1-2\r\n", nil)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Several ranges
+	got = serve(t, "Range: bytes=0-1, -2\r\n", nil)
+	head, body, ok := strings.Cut(got, "\r\n\r\n")
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"))
+	_, boundary, ok := strings.Cut(head, "multipart/byteranges; boundary=")
+	require.True(t, ok)
+	boundary, _, _ = strings.Cut(boundary, "\r\n")
+	assert.Equal(t, "--"+boundary+"\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 0-1/20\r\n\r\n01"+
+		"\r\n--"+boundary+"\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 18-19/20\r\n\r\nij"+
+		"\r\n--"+boundary+"--\r\n", body)
+	assert.Contains(t, head, "Content-Length: "+strconv.Itoa(len(body))+"\r\n")
+
+	// Test: If-Range with the current date
+	got = serve(t, "Range: bytes=0-0\r\nIf-Range: Wed, 16 Apr 2025 10:00:00 GMT\r\n", nil)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 206 Partial Content\r\n"))
+
+	// Test: If-Range with an old date sends everything
+	got = serve(t, "Range: bytes=0-0\r\nIf-Range: Tue, 15 Apr 2025 10:00:00 GMT\r\n", nil)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: If-Range with entity tags
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	got = serve(t, "Range: bytes=0-0\r\nIf-Range: \"v1\"\r\n", h)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, got, "Etag: \"v1\"\r\n")
+	got = serve(t, "Range: bytes=0-0\r\nIf-Range: \"v0\"\r\n", h)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	got = serve(t, "Range: bytes=0-0\r\nIf-Range: W/\"v1\"\r\n", h)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Content-Type set by the caller
+	h = headers.NewHeaders()
+	h.Set("Content-Type", "video/mp4")
+	got = serve(t, "", h)
+	assert.Contains(t, got, "Content-Type: video/mp4\r\n")
+}
+
+// readCounter counts the Read calls on its ReadSeeker.
+type readCounter struct {
+	io.ReadSeeker
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+	return r.ReadSeeker.Read(p)
+}
+
+func TestEvaluatePreconditions(t *testing.T) {
+	modtime := time.Date(2025, time.April, 16, 10, 0, 0, 500, time.UTC)
+	const (
+		before = "Tue, 15 Apr 2025 10:00:00 GMT"
+		same   = "Wed, 16 Apr 2025 10:00:00 GMT"
+		after  = "Thu, 17 Apr 2025 10:00:00 GMT"
+	)
+	tests := []struct {
+		name    string
+		method  string
+		headers string
+		etag    string
+		want    StatusCode
+	}{
+		{"unconditional", "GET", "", `"v1"`, StatusOK},
+		{"if-none-match matches", "GET", "If-None-Match: \"v1\"\r\n", `"v1"`, StatusNotModified},
+		{"if-none-match in a list", "GET", "If-None-Match: \"v0\", \"a,b\", \"v1\"\r\n", `"v1"`, StatusNotModified},
+		{"if-none-match weak comparison", "GET", "If-None-Match: W/\"v1\"\r\n", `"v1"`, StatusNotModified},
+		{"if-none-match other", "GET", "If-None-Match: \"v0\"\r\n", `"v1"`, StatusOK},
+		{"if-none-match star", "HEAD", "If-None-Match: *\r\n", "", StatusNotModified},
+		{"if-none-match unsafe", "PUT", "If-None-Match: \"v1\"\r\n", `"v1"`, StatusPreconditionFailed},
+		{"if-none-match without etag", "GET", "If-None-Match: \"v1\"\r\n", "", StatusOK},
+		{"if-none-match overrides date", "GET", "If-None-Match: \"v0\"\r\nIf-Modified-Since: " + after + "\r\n", `"v1"`, StatusOK},
+		{"if-modified-since same", "GET", "If-Modified-Since: " + same + "\r\n", "", StatusNotModified},
+		{"if-modified-since after", "GET", "If-Modified-Since: " + after + "\r\n", "", StatusNotModified},
+		{"if-modified-since before", "GET", "If-Modified-Since: " + before + "\r\n", "", StatusOK},
+		{"if-modified-since rfc 850", "GET", "If-Modified-Since: Wednesday, 16-Apr-25 10:00:00 GMT\r\n", "", StatusNotModified},
+		{"if-modified-since asctime", "GET", "If-Modified-Since: Wed Apr 16 10:00:00 2025\r\n", "", StatusNotModified},
+		{"if-modified-since invalid", "GET", "If-Modified-Since: yesterday\r\n", "", StatusOK},
+		{"if-modified-since unsafe", "POST", "If-Modified-Since: " + after + "\r\n", "", StatusOK},
+		{"if-match matches", "PUT", "If-Match: \"v1\"\r\n", `"v1"`, StatusOK},
+		{"if-match star", "PUT", "If-Match: *\r\n", "", StatusOK},
+		{"if-match other", "PUT", "If-Match: \"v0\"\r\n", `"v1"`, StatusPreconditionFailed},
+		{"if-match strong comparison", "GET", "If-Match: W/\"v1\"\r\n", `W/"v1"`, StatusPreconditionFailed},
+		{"if-match overrides date", "PUT", "If-Match: \"v1\"\r\nIf-Unmodified-Since: " + before + "\r\n", `"v1"`, StatusOK},
+		{"if-unmodified-since same", "PUT", "If-Unmodified-Since: " + same + "\r\n", "", StatusOK},
+		{"if-unmodified-since before", "DELETE", "If-Unmodified-Since: " + before + "\r\n", "", StatusPreconditionFailed},
+		{"if-match before if-none-match", "GET", "If-Match: \"v0\"\r\nIf-None-Match: \"v1\"\r\n", `"v1"`, StatusPreconditionFailed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := request.RequestFromReader(strings.NewReader(tc.method + " /video HTTP/1.1\r\nHost: localhost\r\n" + tc.headers + "\r\n"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, EvaluatePreconditions(req, tc.etag, modtime))
+		})
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	modtime := time.Date(2025, time.April, 16, 10, 0, 0, 0, time.UTC)
+
+	serve := func(t *testing.T, req string, h *headers.Headers) string {
+		r, err := request.RequestFromReader(strings.NewReader(req))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		w := newTestWriter(&buf)
+		require.NoError(t, ServeContent(w, r, "notes.txt", modtime, strings.NewReader(content), h))
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+
+	// Test: Not modified since
+	got := serve(t, "GET / HTTP/1.1\r\nHost: localhost\r\nIf-Modified-Since: Wed, 16 Apr 2025 10:00:00 GMT\r\n\r\n", nil)
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nLast-Modified: Wed, 16 Apr 2025 10:00:00 GMT\r\n"+testDate+"\r\n", got)
+
+	// Test: Not modified, only cache headers are kept
+	h := headers.NewHeaders()
+	h.Set("ETag", StrongETag([]byte(content)))
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Vary", "Accept-Encoding")
+	h.Set("X-Other", "dropped")
+	got = serve(t, "GET / HTTP/1.1\r\nHost: localhost\r\nIf-None-Match: "+StrongETag([]byte(content))+"\r\n\r\n", h)
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nEtag: "+StrongETag([]byte(content))+"\r\n"+
+		"Cache-Control: no-cache\r\nVary: Accept-Encoding\r\n"+testDate+"\r\n", got)
+
+	// Test: Modified
+	got = serve(t, "GET / HTTP/1.1\r\nHost: localhost\r\nIf-None-Match: \"stale\"\r\n\r\n", h)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(got, "\r\n\r\n"+content))
+
+	// Test: Precondition failed
+	got = serve(t, "GET / HTTP/1.1\r\nHost: localhost\r\nIf-Match: \"stale\"\r\nRange: bytes=0-1\r\n\r\n", h)
+	assert.Equal(t, "HTTP/1.1 412 Precondition Failed\r\n"+testDate+"Content-Length: 0\r\n\r\n", got)
+
+	// Test: Preconditions hold, the range is served
+	got = serve(t, "GET / HTTP/1.1\r\nHost: localhost\r\nIf-Match: "+StrongETag([]byte(content))+"\r\nRange: bytes=0-1\r\n\r\n", h)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 206 Partial Content\r\n"))
+}
+
+func TestETags(t *testing.T) {
+	// Test: Strong tags follow the content
+	assert.Equal(t, StrongETag([]byte("a")), StrongETag([]byte("a")))
+	assert.NotEqual(t, StrongETag([]byte("a")), StrongETag([]byte("b")))
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, StrongETag(nil))
+
+	// Test: Weak tags follow the size and modification time
+	modtime := time.Date(2025, time.April, 16, 10, 0, 0, 0, time.UTC)
+	assert.Regexp(t, `^W/"[0-9a-f]+-a"$`, WeakETag(10, modtime))
+	assert.NotEqual(t, WeakETag(10, modtime), WeakETag(11, modtime))
+	assert.NotEqual(t, WeakETag(10, modtime), WeakETag(10, modtime.Add(time.Millisecond)))
+
+	// Test: Entity tag lists
+	assert.Equal(t, []string{`"a"`, `W/"b"`, `"c,d"`}, etagList(` "a",W/"b" , "c,d",`))
+	assert.Equal(t, []string{`"a"`}, etagList(`"a", b, "c"`))
+	assert.Empty(t, etagList(`"unterminated`))
+}
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Good status line
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+
+	// Test: Reason phrase with spaces
+	reader = &chunkReader{
+		data:            "HTTP/1.0 404 Not Found Here\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusNotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found Here", r.StatusLine.ReasonPhrase)
+
+	// Test: Empty reason phrase, with and without its space
+	for _, line := range []string{"HTTP/1.1 599 ", "HTTP/1.1 599"} {
+		r, err = ResponseFromReader(strings.NewReader(line + "\r\nContent-Length: 0\r\n\r\n"))
+		require.NoError(t, err, line)
+		assert.Equal(t, StatusCode(599), r.StatusLine.StatusCode)
+		assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+	}
+
+	// Test: Malformed status lines
+	for _, line := range []string{
+		"HTTP/1.1",
+		"HTTP/1.1  200 OK",
+		"HTTP/1.1 20 OK",
+		"HTTP/1.1 2000 OK",
+		"HTTP/1.1 099 Low",
+		"HTTP/1.1 abc OK",
+		"HTTP/11 200 OK",
+		"HTTP/2.0 200 OK",
+		"http/1.1 200 OK",
+		"ICY 200 OK",
+	} {
+		_, err = ResponseFromReader(strings.NewReader(line + "\r\n\r\n"))
+		require.ErrorIs(t, err, ErrMalformedStatusLine, line)
+	}
+
+	// Test: Status line too long
+	p := NewParser(strings.NewReader("HTTP/1.1 200 " + strings.Repeat("A", 100) + "\r\n\r\n"))
+	p.Limits.MaxRequestLineBytes = 64
+	_, err = p.Next("GET")
+	require.ErrorIs(t, err, request.ErrLineTooLong)
+
+	// Test: Empty connection
+	_, err = ResponseFromReader(strings.NewReader(""))
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection closed in the headers
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestResponseBody(t *testing.T) {
+	// Test: Content-Length body
+	reader := &chunkReader{
+		data: "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), r.ContentLength)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+	assert.True(t, r.KeepAlive())
+
+	// Test: Content-Length body cut short
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial content"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Invalid Content-Length
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 1, 2\r\n\r\nab"))
+	require.ErrorIs(t, err, request.ErrBadContentLength)
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Content-Length\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"6;ext=1\r\nworld!\r\n" +
+			"0\r\n" +
+			"X-Content-Length: 12\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+	trailer, _ := r.Trailers.Get("X-Content-Length")
+	assert.Equal(t, "12", trailer)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Chunked body cut short
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhel"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Close-delimited body
+	reader = &chunkReader{
+		data:            "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the very end",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "until the very end", string(body))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Transfer coding other than chunked last is close-delimited
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked, gzip\r\n\r\nraw bytes"))
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "raw bytes", string(body))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Transfer-Encoding overrides Content-Length
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Responses without a body
+	for _, tc := range []struct {
+		method, response string
+		contentLength    int64
+	}{
+		{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n", 1000},
+		{"HEAD", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", -1},
+		{"GET", "HTTP/1.1 204 No Content\r\n\r\n", -1},
+		{"GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 1000\r\n\r\n", 1000},
+		{"CONNECT", "HTTP/1.1 200 Connection Established\r\n\r\n", -1},
+	} {
+		p := NewParser(strings.NewReader(tc.response + "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nnext"))
+		r, err := p.Next(tc.method)
+		require.NoError(t, err, tc.response)
+		assert.Equal(t, tc.contentLength, r.ContentLength, tc.response)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Empty(t, body, tc.response)
+		assert.True(t, r.KeepAlive(), tc.response)
+
+		// the next response starts right after the header section
+		r, err = p.Next("GET")
+		require.NoError(t, err, tc.response)
+		body, err = io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "next", string(body), tc.response)
+	}
+}
+
+func TestInterimResponsesParse(t *testing.T) {
+	// Test: 1xx responses before the final one
+	reader := &chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\n" +
+			"Link: </style.css>; rel=preload; as=style\r\n" +
+			"\r\n" +
+			"HTTP/1.1 201 Created\r\n" +
+			"Content-Length: 2\r\n" +
+			"\r\n" +
+			"ok",
+		numBytesPerRead: 5,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCreated, r.StatusLine.StatusCode)
+	require.Len(t, r.Interim, 2)
+	assert.Equal(t, StatusContinue, r.Interim[0].StatusLine.StatusCode)
+	assert.Equal(t, StatusEarlyHints, r.Interim[1].StatusLine.StatusCode)
+	link, _ := r.Interim[1].Headers.Get("Link")
+	assert.Equal(t, "</style.css>; rel=preload; as=style", link)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+
+	// Test: Connection closed after an interim response
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 100 Continue\r\n\r\n"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: 101 is final, and the body is the rest of the connection
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n\x81\x02hi"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusSwitchingProtocols, r.StatusLine.StatusCode)
+	assert.Empty(t, r.Interim)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "\x81\x02hi", string(body))
+	assert.False(t, r.KeepAlive())
+}
+
+func TestParserKeepAlive(t *testing.T) {
+	// Test: Several responses on one connection, the unread rest of a body skipped
+	reader := &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nfirst body!" +
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nsecond\r\n0\r\n\r\n" +
+			"HTTP/1.1 404 Not Found\r\nContent-Length: 5\r\nConnection: close\r\n\r\nthird",
+		numBytesPerRead: 7,
+	}
+	p := NewParser(reader)
+
+	r, err := p.Next("GET")
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(r.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(buf))
+	require.NoError(t, r.Body.Close())
+
+	r, err = p.Next("GET")
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	assert.True(t, r.KeepAlive())
+
+	r, err = p.Next("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusNotFound, r.StatusLine.StatusCode)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "third", string(body))
+	assert.False(t, r.KeepAlive())
+
+	_, err = p.Next("GET")
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: HTTP/1.0 keep-alive
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+}
+
+func TestWriterParserRoundTrip(t *testing.T) {
+	// Test: What the Writer sends, the Parser reads back
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteContinue())
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteHeaders(h))
+	cw := NewChunkedWriterSize(w, 4)
+	_, err := io.WriteString(cw, "streamed body")
+	require.NoError(t, err)
+	cw.Trailers = headers.NewHeaders()
+	cw.Trailers.Set("X-Checksum", "abc")
+	require.NoError(t, cw.Close())
+
+	r, err := ResponseFromReader(&chunkReader{data: buf.String(), numBytesPerRead: 3})
+	require.NoError(t, err)
+	require.Len(t, r.Interim, 1)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed body", string(body))
+	checksum, _ := r.Trailers.Get("X-Checksum")
+	assert.Equal(t, "abc", checksum)
+}
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call,
+// simulating a network connection that delivers a response a bit at a time.
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+)
+
+// FileServerOption configures a Handler made by FileServer.
+type FileServerOption func(*fileServer)
+
+// WithIndexFiles sets the files served for a directory, the first one that
+// exists wins. The default is index.html.
+func WithIndexFiles(names ...string) FileServerOption {
+	return func(fsrv *fileServer) {
+		fsrv.indexFiles = names
+	}
+}
+
+// WithDirectoryListing lists the contents of directories without an index
+// file as HTML. Without it they are answered with 404 Not Found.
+func WithDirectoryListing() FileServerOption {
+	return func(fsrv *fileServer) {
+		fsrv.listDirectories = true
+	}
+}
+
+type fileServer struct {
+	dir             string
+	indexFiles      []string
+	listDirectories bool
+}
+
+// FileServer returns a Handler that serves the tree of files under dir,
+// the request path naming a file relative to it. Files are sent with
+// ServeContent, so range and conditional requests work, and have a
+// Content-Type from their extension.
+//
+// Nothing outside dir can be reached: a path with ".." in it is rejected
+// with 400, and symbolic links leading out of dir are not followed.
+// Use StripPrefix to serve dir under some other path than "/".
+func FileServer(dir string, opts ...FileServerOption) Handler {
+	fsrv := &fileServer{dir: dir, indexFiles: []string{"index.html"}}
+	for _, opt := range opts {
+		opt(fsrv)
+	}
+	return fsrv.serve
+}
+
+// StripPrefix returns a Handler that removes prefix from the request path
+// before handing the request to h, and answers 404 Not Found to requests
+// whose path does not start with it.
+func StripPrefix(prefix string, h Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		p, ok := strings.CutPrefix(req.Path(), prefix)
+		if !ok || req.URL == nil {
+			writeError(w, req, response.StatusNotFound, "not found")
+			return
+		}
+		u := *req.URL
+		u.Path = p
+		u.RawPath = ""
+		req.URL = &u
+		h(w, req)
+	}
+}
+
+// ServeFile replies to req with the contents of the file name, or 404 Not
+// Found when there is no such file. Unlike FileServer, name is trusted and
+// may be anywhere; never build it from the request path.
+func ServeFile(w *response.Writer, req *request.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		writeFileError(w, req, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		writeFileError(w, req, err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		writeError(w, req, response.StatusNotFound, "not found")
+		return
+	}
+	serveFile(w, req, f, fi)
+}
+
+func (fsrv *fileServer) serve(w *response.Writer, req *request.Request) {
+	if method := req.RequestLine.Method; method != "GET" && method != "HEAD" {
+		h := headers.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		writeErrorHeaders(w, req, response.StatusMethodNotAllowed, "method not allowed", h)
+		return
+	}
+
+	p := req.Path()
+	if !strings.HasPrefix(p, "/") || strings.ContainsRune(p, 0) || slices.Contains(strings.Split(p, "/"), "..") {
+		writeError(w, req, response.StatusBadRequest, "invalid path")
+		return
+	}
+	name := strings.TrimPrefix(path.Clean(p), "/")
+	if name == "" {
+		name = "."
+	}
+
+	// an os.Root refuses to open anything outside dir, symbolic links included
+	root, err := os.OpenRoot(fsrv.dir)
+	if err != nil {
+		writeFileError(w, req, err)
+		return
+	}
+	defer root.Close()
+
+	f, err := root.Open(name)
+	if err != nil {
+		writeFileError(w, req, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		writeFileError(w, req, err)
+		return
+	}
+
+	if fi.IsDir() {
+		if !strings.HasSuffix(p, "/") {
+			// relative links in the directory's page only work from below it
+			u := *req.URL
+			u.Path += "/"
+			u.RawPath = ""
+			h := headers.NewHeaders()
+			h.Set("Location", u.RequestURI())
+			writeErrorHeaders(w, req, response.StatusMovedPermanently, "moved to "+u.Path, h)
+			return
+		}
+		fsrv.serveDir(w, req, root, name, f)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		writeError(w, req, response.StatusNotFound, "not found")
+		return
+	}
+	serveFile(w, req, f, fi)
+}
+
+// serveDir serves the first index file in dir, or else its listing.
+func (fsrv *fileServer) serveDir(w *response.Writer, req *request.Request, root *os.Root, name string, dir *os.File) {
+	for _, index := range fsrv.indexFiles {
+		f, err := root.Open(path.Join(name, index))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			serveFile(w, req, f, fi)
+			return
+		}
+	}
+
+	if !fsrv.listDirectories {
+		writeError(w, req, response.StatusNotFound, "not found")
+		return
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		writeFileError(w, req, err)
+		return
+	}
+	listDir(w, req, entries)
+}
+
+// listDir writes an HTML page linking to each of entries, sorted by name.
+func listDir(w *response.Writer, req *request.Request, entries []fs.DirEntry) {
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	var b strings.Builder
+	title := html.EscapeString(req.Path())
+	fmt.Fprintf(&b, "<html>\n  <head>\n    <title>%s</title>\n  </head>\n  <body>\n    <h1>%s</h1>\n    <ul>\n", title, title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		// "./" keeps a name with a colon in it from reading as a URL scheme
+		link := "./" + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&b, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(name))
+	}
+	b.WriteString("    </ul>\n  </body>\n</html>\n")
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.String()))
+}
+
+// serveFile sends the regular file f with a strong ETag from its size and
+// modification time, as hashing it for every request would cost too much.
+// Any write to a file moves its modification time on, in nanoseconds, so the
+// tag changes with the content and If-Range can resume downloads with it.
+func serveFile(w *response.Writer, req *request.Request, f *os.File, fi fs.FileInfo) {
+	h := headers.NewHeaders()
+	h.Set("ETag", response.FileETag(fi.Size(), fi.ModTime()))
+	if err := response.ServeContent(w, req, fi.Name(), fi.ModTime(), f, h); err != nil {
+		log.Printf("error serving %s: %v", fi.Name(), err)
+		if w.Written() {
+			w.Abort() // the client has part of the file, it must not take it for all of it
+			return
+		}
+		writeError(w, req, response.StatusInternalServerError, "could not read file")
+	}
+}
+
+// writeFileError answers a request for a file that could not be opened. A file
+// outside the served directory is as good as missing.
+func writeFileError(w *response.Writer, req *request.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		writeError(w, req, response.StatusForbidden, "forbidden")
+	default:
+		writeError(w, req, response.StatusNotFound, "not found")
+	}
+}
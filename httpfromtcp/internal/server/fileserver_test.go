@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveRequest runs h on the raw request, as the server would, and returns the raw response.
+func serveRequest(t *testing.T, h Handler, raw string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	if req.RequestLine.Method == "HEAD" {
+		w.OmitBody()
+	}
+	h(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
+
+func get(target string) string {
+	return "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+}
+
+func TestFileServer(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello, world"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "style.css"), []byte("body {}"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "site"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "site", "index.html"), []byte("<h1>site</h1>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "a <b>.txt"), []byte("a"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "escape.txt")))
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(dir, "link.txt")))
+
+	fs := FileServer(dir)
+
+	// Test: File with its type, length and validators
+	got := serveRequest(t, fs, get("/hello.txt"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, got, "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, got, "Content-Length: 12\r\n")
+	assert.Contains(t, got, "Etag: \"")
+	assert.Contains(t, got, "Last-Modified: ")
+	assert.True(t, strings.HasSuffix(got, "\r\n\r\nhello, world"))
+
+	got = serveRequest(t, fs, get("/style.css"))
+	assert.Contains(t, got, "Content-Type: text/css; charset=utf-8\r\n")
+
+	// Test: Range request
+	got = serveRequest(t, fs, "GET /hello.txt HTTP/1.1\r\nHost: localhost\r\nRange: bytes=7-\r\n\r\n")
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, got, "Content-Range: bytes 7-11/12\r\n")
+	assert.True(t, strings.HasSuffix(got, "\r\n\r\nworld"))
+
+	// Test: Conditional request
+	fi, err := os.Stat(filepath.Join(dir, "hello.txt"))
+	require.NoError(t, err)
+	etag := response.FileETag(fi.Size(), fi.ModTime())
+	got = serveRequest(t, fs, "GET /hello.txt HTTP/1.1\r\nHost: localhost\r\nIf-None-Match: "+etag+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 304 Not Modified\r\n"))
+
+	// Test: Resumed download with If-Range, by entity tag or by date
+	for _, ifRange := range []string{etag, fi.ModTime().UTC().Format(headers.TimeFormat)} {
+		got = serveRequest(t, fs, "GET /hello.txt HTTP/1.1\r\nHost: localhost\r\nRange: bytes=7-\r\nIf-Range: "+ifRange+"\r\n\r\n")
+		assert.True(t, strings.HasPrefix(got, "HTTP/1.1 206 Partial Content\r\n"), ifRange)
+		assert.True(t, strings.HasSuffix(got, "\r\n\r\nworld"), ifRange)
+	}
+
+	// Test: If-Range that does not match gets the whole file
+	for _, ifRange := range []string{`"other"`, "W/" + etag, "Mon, 01 Jan 2001 00:00:00 GMT"} {
+		got = serveRequest(t, fs, "GET /hello.txt HTTP/1.1\r\nHost: localhost\r\nRange: bytes=7-\r\nIf-Range: "+ifRange+"\r\n\r\n")
+		assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"), ifRange)
+		assert.True(t, strings.HasSuffix(got, "\r\n\r\nhello, world"), ifRange)
+	}
+
+	// Test: Missing file
+	got = serveRequest(t, fs, get("/missing.txt"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Index file
+	got = serveRequest(t, fs, get("/site/"))
+	assert.Contains(t, got, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(got, "<h1>site</h1>"))
+
+	// Test: Directory without a trailing slash
+	got = serveRequest(t, fs, get("/site?x=1"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, got, "Location: /site/?x=1\r\n")
+
+	// Test: Directory listings are off by default
+	got = serveRequest(t, fs, get("/docs/"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Path traversal
+	got = serveRequest(t, fs, get("/../secret.txt"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 400 Bad Request\r\n"))
+	got = serveRequest(t, fs, get("/docs/%2e%2e/%2e%2e/secret.txt"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: Symbolic links
+	got = serveRequest(t, fs, get("/escape.txt"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+	assert.NotContains(t, got, "secret")
+	got = serveRequest(t, fs, get("/link.txt"))
+	assert.True(t, strings.HasSuffix(got, "\r\n\r\nhello, world"))
+
+	// Test: Method not allowed
+	got = serveRequest(t, fs, "DELETE /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, got, "Allow: GET, HEAD\r\n")
+
+	// Test: Directory listing
+	fs = FileServer(dir, WithDirectoryListing(), WithIndexFiles("default.htm"))
+	got = serveRequest(t, fs, get("/docs/"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, got, `<li><a href="./a%20%3Cb%3E.txt">a &lt;b&gt;.txt</a></li>`)
+	got = serveRequest(t, fs, get("/"))
+	assert.Contains(t, got, `<li><a href="./docs/">docs/</a></li>`)
+	assert.Contains(t, got, `<li><a href="./site/">site/</a></li>`)
+
+	// Test: Mounted under a prefix
+	fs = StripPrefix("/static", FileServer(dir))
+	got = serveRequest(t, fs, get("/static/hello.txt"))
+	assert.True(t, strings.HasSuffix(got, "\r\n\r\nhello, world"))
+	got = serveRequest(t, fs, get("/hello.txt"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+}
+
+func TestServeFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clip.mp4"), []byte("not really a video"), 0o644))
+
+	// Test: Existing file
+	got := serveRequest(t, func(w *response.Writer, req *request.Request) {
+		ServeFile(w, req, filepath.Join(dir, "clip.mp4"))
+	}, get("/video"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, got, "Content-Type: video/mp4\r\n")
+
+	// Test: Missing file
+	got = serveRequest(t, func(w *response.Writer, req *request.Request) {
+		ServeFile(w, req, filepath.Join(dir, "missing.mp4"))
+	}, get("/video"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Directory
+	got = serveRequest(t, func(w *response.Writer, req *request.Request) {
+		ServeFile(w, req, dir)
+	}, get("/video"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+}
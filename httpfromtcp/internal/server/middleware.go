@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+)
+
+// Middleware wraps a Handler with behavior shared by many handlers. It sees
+// the response through the writer's OnHeader and OnFinish hooks.
+type Middleware func(Handler) Handler
+
+// Chain returns a Middleware applying mws in order, the first one outermost:
+// Chain(a, b)(h) is a(b(h)).
+func Chain(mws ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// LogFormat is the line format of Logger.
+type LogFormat int
+
+const (
+	// CommonLog is the Common Log Format:
+	//
+	//	host ident authuser [date] "request-line" status bytes
+	CommonLog LogFormat = iota
+	// CombinedLog is CommonLog followed by the quoted Referer and User-Agent.
+	CombinedLog
+)
+
+// clfTimeFormat is the layout of the date in Common Log Format lines.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Logger writes a line to out for each response once it is finished. The
+// date is when the request came in, and the bytes are those of the body.
+func Logger(out io.Writer, format LogFormat) Middleware {
+	var mu sync.Mutex
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			w.OnFinish(func() {
+				line := logLine(format, req, w.Status(), w.BytesWritten(), start)
+				mu.Lock()
+				defer mu.Unlock()
+				io.WriteString(out, line)
+			})
+			next(w, req)
+		}
+	}
+}
+
+func logLine(format LogFormat, req *request.Request, status response.StatusCode, n int64, start time.Time) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] \"%s %s HTTP/%s\" %s %s",
+		logField(host),
+		start.Format(clfTimeFormat),
+		logEscape(req.RequestLine.Method),
+		logEscape(req.RequestLine.RequestTarget),
+		logEscape(req.RequestLine.HttpVersion),
+		logNumber(int64(status)),
+		logNumber(n),
+	)
+	if format == CombinedLog {
+		referer, _ := req.Headers.Get("Referer")
+		userAgent, _ := req.Headers.Get("User-Agent")
+		fmt.Fprintf(&b, " \"%s\" \"%s\"", logField(logEscape(referer)), logField(logEscape(userAgent)))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// logField returns s, or "-" for an empty field.
+func logField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logNumber formats n, or "-" for 0 as CLF does for bytes.
+func logNumber(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// logEscape escapes quotes, backslashes and control characters in s, so
+// that a client cannot forge fields or lines in the log.
+func logEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// RequestIDHeader carries the ID set by RequestID.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDBytes caps the length of an ID sent by the client.
+const maxRequestIDBytes = 128
+
+// RequestID gives each request an ID, kept from the X-Request-Id header of
+// the request when it is a token, generated otherwise. The ID is set in the
+// request headers, for handlers and inner middleware to read, and in the
+// response headers.
+func RequestID() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id, _ := req.Headers.Get(RequestIDHeader)
+			if len(id) > maxRequestIDBytes || !headers.IsToken(id) {
+				id = newRequestID()
+				req.Headers.Set(RequestIDHeader, id)
+			}
+			w.OnHeader(func(_ response.StatusCode, h *headers.Headers) {
+				h.Set(RequestIDHeader, id)
+			})
+			next(w, req)
+		}
+	}
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Recover answers 500 Internal Server Error to a request whose handler
+// panics, and logs the panic with its stack. If the response was already
+// started it is aborted instead, so the client can tell it is incomplete.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, v, debug.Stack())
+				if w.Written() {
+					w.Abort()
+					return
+				}
+				w.CloseAfterResponse()
+				writeError(w, req, response.StatusInternalServerError, "internal server error")
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// Timing adds a Server-Timing header with the time the handler took until
+// its response headers went out, for browser developer tools to show.
+// https://www.w3.org/TR/server-timing/
+func Timing() Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			w.OnHeader(func(_ response.StatusCode, h *headers.Headers) {
+				elapsed := time.Since(start)
+				h.Add("Server-Timing", fmt.Sprintf("app;dur=%.3f", float64(elapsed.Microseconds())/1000))
+			})
+			next(w, req)
+		}
+	}
+}
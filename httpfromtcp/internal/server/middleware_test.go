@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name+" in")
+				next(w, req)
+				order = append(order, name+" out")
+			}
+		}
+	}
+
+	// Test: First middleware is outermost
+	h := Chain(mw("a"), mw("b"))(reply("h"))
+	assert.Equal(t, "h", body(serveRequest(t, h, get("/"))))
+	assert.Equal(t, []string{"a in", "b in", "b out", "a out"}, order)
+
+	// Test: Empty chain is the handler itself
+	assert.Equal(t, "h", body(serveRequest(t, Chain()(reply("h")), get("/"))))
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	raw := "GET /users/42?x=1 HTTP/1.1\r\nHost: localhost\r\nReferer: http://localhost/\r\nUser-Agent: curl/8.0\r\n\r\n"
+
+	// Test: Common Log Format
+	h := Logger(&out, CommonLog)(reply("hello"))
+	serveRequest(t, h, raw)
+	assert.Regexp(t, `^- - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /users/42\?x=1 HTTP/1.1" 200 5\n$`, out.String())
+
+	// Test: Combined Log Format
+	out.Reset()
+	h = Logger(&out, CombinedLog)(func(w *response.Writer, req *request.Request) {
+		writeError(w, req, response.StatusNotFound, "not found")
+	})
+	serveRequest(t, h, raw)
+	assert.Regexp(t, `" 404 10 "http://localhost/" "curl/8.0"\n$`, out.String())
+
+	// Test: Missing fields and empty body
+	out.Reset()
+	h = Logger(&out, CombinedLog)(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusNoContent)
+		w.WriteHeaders(response.GetEmptyHeaders())
+	})
+	serveRequest(t, h, get("/"))
+	assert.Regexp(t, `"GET / HTTP/1.1" 204 - "-" "-"\n$`, out.String())
+
+	// Test: Quotes and control characters are escaped
+	out.Reset()
+	h = Logger(&out, CombinedLog)(reply("x"))
+	serveRequest(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\nUser-Agent: evil\" \xff\\\r\n\r\n")
+	assert.Regexp(t, regexp.QuoteMeta(`"evil\" \xff\\"`)+"\n$", out.String())
+
+	// Test: Client address without its port
+	out.Reset()
+	req, err := request.RequestFromReader(strings.NewReader(get("/")))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:54321"
+	w := response.NewResponseWriter(&bytes.Buffer{})
+	Logger(&out, CommonLog)(reply("x"))(w, req)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "192.0.2.1 - - ["))
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID()(func(w *response.Writer, req *request.Request) {
+		seen, _ = req.Headers.Get(RequestIDHeader)
+		w.WriteBody([]byte("ok"))
+	})
+
+	// Test: Generated when missing, on the request and the response
+	got := serveRequest(t, h, get("/"))
+	assert.Regexp(t, `^[0-9a-f]{32}$`, seen)
+	assert.Contains(t, got, "X-Request-Id: "+seen+"\r\n")
+
+	// Test: Each request gets its own
+	first := seen
+	serveRequest(t, h, get("/"))
+	assert.NotEqual(t, first, seen)
+
+	// Test: Kept from the client
+	got = serveRequest(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: abc-123\r\n\r\n")
+	assert.Equal(t, "abc-123", seen)
+	assert.Contains(t, got, "X-Request-Id: abc-123\r\n")
+
+	// Test: Replaced when not a token
+	got = serveRequest(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: a b\r\n\r\n")
+	assert.Regexp(t, `^[0-9a-f]{32}$`, seen)
+	assert.Contains(t, got, "X-Request-Id: "+seen+"\r\n")
+	got = serveRequest(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: "+strings.Repeat("a", 129)+"\r\n\r\n")
+	assert.Regexp(t, `^[0-9a-f]{32}$`, seen)
+}
+
+func TestRecover(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// Test: Panic before the response becomes a 500
+	h := Recover()(func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	})
+	got := serveRequest(t, h, get("/"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.Contains(t, got, "Connection: close\r\n")
+
+	// Test: Panic during the response aborts it
+	h = Recover()(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(100))
+		w.Write([]byte(strings.Repeat("a", 5000)))
+		panic("boom")
+	})
+	req, err := request.RequestFromReader(strings.NewReader(get("/")))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	assert.NotPanics(t, func() { h(w, req) })
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	assert.False(t, strings.Contains(buf.String(), "500"))
+
+	// Test: Logged with the status of the 500
+	var out bytes.Buffer
+	h = Chain(Logger(&out, CommonLog), Recover())(func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	})
+	serveRequest(t, h, get("/"))
+	assert.Regexp(t, `" 500 \d+\n$`, out.String())
+}
+
+func TestTiming(t *testing.T) {
+	// Test: Added to whatever headers the handler writes
+	h := Timing()(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.Write([]byte("ok"))
+	})
+	got := serveRequest(t, h, get("/"))
+	assert.Regexp(t, `\r\nServer-Timing: app;dur=\d+\.\d{3}\r\n`, got)
+
+	// Test: And to the default ones
+	got = serveRequest(t, Timing()(reply("ok")), get("/"))
+	assert.Regexp(t, `\r\nServer-Timing: app;dur=\d+\.\d{3}\r\n`, got)
+}
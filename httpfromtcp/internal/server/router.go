@@ -0,0 +1,307 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/livingpool/httpfromtcp/internal/headers"
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+)
+
+// Router is a Handler that sends each request to the handler registered for
+// its method and path. Patterns are paths whose segments may be wildcards:
+//
+//	/users/{id}        matches /users/42, with PathValue("id") == "42"
+//	/files/{path...}   matches /files/ and everything below it, not /files
+//
+// A {name} wildcard matches one non-empty segment. A {name...} wildcard must
+// be last and matches the rest of the path, which may be empty. When several
+// patterns match, the most specific wins: a literal segment beats {name},
+// which beats {name...}, comparing segment by segment from the left.
+//
+// Requests whose path matches a route but whose method does not are answered
+// 405 Method Not Allowed with an Allow header, and requests no route matches
+// 404 Not Found. HEAD requests go to the GET handler unless a HEAD route is
+// registered, and OPTIONS requests are answered with the allowed methods
+// unless an OPTIONS route is registered.
+type Router struct {
+	RouteGroup
+
+	// NotFound handles requests no route matches. nil answers 404 Not Found.
+	NotFound Handler
+
+	routes []*route
+}
+
+// RouteGroup registers routes under a shared path prefix.
+type RouteGroup struct {
+	router *Router
+	prefix string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  Handler
+}
+
+type segmentKind int
+
+// Ordered from most to least specific.
+const (
+	literalSegment segmentKind = iota
+	paramSegment
+	restSegment
+)
+
+type segment struct {
+	kind segmentKind
+	// text is the literal, or the name of the wildcard.
+	text string
+}
+
+func NewRouter() *Router {
+	r := &Router{}
+	r.RouteGroup = RouteGroup{router: r}
+	return r
+}
+
+// Handle registers h for requests with method whose path matches pattern,
+// below the group's prefix. It panics if the pattern is malformed or another
+// route already has the same method and pattern shape.
+func (g *RouteGroup) Handle(method, pattern string, h Handler) {
+	if method == "" || !headers.IsToken(method) {
+		panic(fmt.Sprintf("router: invalid method %q", method))
+	}
+	if h == nil {
+		panic("router: nil handler for " + method + " " + pattern)
+	}
+	pattern = g.prefix + pattern
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("router: %s %s: %v", method, pattern, err))
+	}
+	rt := &route{method: method, pattern: pattern, segments: segments, handler: h}
+	for _, other := range g.router.routes {
+		if other.method == method && sameShape(other.segments, segments) {
+			panic(fmt.Sprintf("router: %s %s conflicts with %s", method, pattern, other.pattern))
+		}
+	}
+	g.router.routes = append(g.router.routes, rt)
+}
+
+func (g *RouteGroup) Get(pattern string, h Handler)    { g.Handle("GET", pattern, h) }
+func (g *RouteGroup) Post(pattern string, h Handler)   { g.Handle("POST", pattern, h) }
+func (g *RouteGroup) Put(pattern string, h Handler)    { g.Handle("PUT", pattern, h) }
+func (g *RouteGroup) Patch(pattern string, h Handler)  { g.Handle("PATCH", pattern, h) }
+func (g *RouteGroup) Delete(pattern string, h Handler) { g.Handle("DELETE", pattern, h) }
+
+// Group returns a group whose routes are registered below prefix, which is
+// added to the patterns as is: Group("/api").Get("/users", h) is
+// Get("/api/users", h).
+func (g *RouteGroup) Group(prefix string) *RouteGroup {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		panic(fmt.Sprintf("router: group prefix %q must start and not end with /", prefix))
+	}
+	return &RouteGroup{router: g.router, prefix: g.prefix + prefix}
+}
+
+// parsePattern splits pattern into its segments.
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern must start with /")
+	}
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	seen := map[string]bool{}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("wildcard must be a whole segment: %q", part)
+			}
+			segments = append(segments, segment{kind: literalSegment, text: part})
+			continue
+		}
+		name, ok := strings.CutSuffix(part[1:], "}")
+		if !ok {
+			return nil, fmt.Errorf("unclosed wildcard: %q", part)
+		}
+		kind := paramSegment
+		if n, rest := strings.CutSuffix(name, "..."); rest {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("%s must be the last segment", part)
+			}
+			name, kind = n, restSegment
+		}
+		if name == "" || strings.ContainsAny(name, "{}./") {
+			return nil, fmt.Errorf("invalid wildcard name: %q", part)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate wildcard name: %q", name)
+		}
+		seen[name] = true
+		segments = append(segments, segment{kind: kind, text: name})
+	}
+	return segments, nil
+}
+
+// sameShape reports whether a and b match exactly the same paths.
+func sameShape(a, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x, y segment) bool {
+		return x.kind == y.kind && (x.kind != literalSegment || x.text == y.text)
+	})
+}
+
+// match reports whether the path, split into its escaped segments, matches
+// the route, and returns the decoded wildcard values.
+func (rt *route) match(parts []string) (map[string]string, bool) {
+	var values map[string]string
+	for i, seg := range rt.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+		if seg.kind == restSegment {
+			value, err := url.PathUnescape(strings.Join(parts[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[seg.text] = value
+			return values, true
+		}
+		value, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		switch seg.kind {
+		case literalSegment:
+			if value != seg.text {
+				return nil, false
+			}
+		case paramSegment:
+			if value == "" {
+				return nil, false
+			}
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[seg.text] = value
+		}
+	}
+	return values, len(parts) == len(rt.segments)
+}
+
+// moreSpecific reports whether a should win over b when both match a path.
+func moreSpecific(a, b *route) bool {
+	for i := range min(len(a.segments), len(b.segments)) {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind < b.segments[i].kind
+		}
+	}
+	return len(a.segments) > len(b.segments)
+}
+
+// Serve dispatches req to the handler of the route that matches it best.
+// The path values of the route's wildcards are set on req.
+func (r *Router) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if req.TargetForm == request.AsteriskForm && method == "OPTIONS" {
+		// OPTIONS * asks about the server as a whole. RFC 9110 9.3.7
+		writeOptions(w, r.routes)
+		return
+	}
+
+	var matched []*route
+	var values []map[string]string
+	if p := escapedPath(req); strings.HasPrefix(p, "/") {
+		parts := strings.Split(p[1:], "/")
+		for _, rt := range r.routes {
+			if v, ok := rt.match(parts); ok {
+				matched = append(matched, rt)
+				values = append(values, v)
+			}
+		}
+	}
+	if len(matched) == 0 {
+		if r.NotFound != nil {
+			r.NotFound(w, req)
+			return
+		}
+		writeError(w, req, response.StatusNotFound, "not found")
+		return
+	}
+
+	i := best(matched, method)
+	if i < 0 && method == "HEAD" {
+		i = best(matched, "GET")
+	}
+	if i < 0 {
+		if method == "OPTIONS" {
+			writeOptions(w, matched)
+			return
+		}
+		h := headers.NewHeaders()
+		h.Set("Allow", allow(matched))
+		writeErrorHeaders(w, req, response.StatusMethodNotAllowed, "method not allowed", h)
+		return
+	}
+
+	for name, value := range values[i] {
+		req.SetPathValue(name, value)
+	}
+	matched[i].handler(w, req)
+}
+
+// best returns the index of the most specific route for method, or -1.
+func best(matched []*route, method string) int {
+	best := -1
+	for i, rt := range matched {
+		if rt.method == method && (best < 0 || moreSpecific(rt, matched[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+// writeOptions answers an OPTIONS request with the methods routes allow.
+func writeOptions(w *response.Writer, routes []*route) {
+	h := response.GetEmptyHeaders()
+	h.Set("Allow", allow(routes))
+	w.WriteStatusLine(response.StatusNoContent)
+	w.WriteHeaders(h)
+}
+
+// allow lists the methods of routes for an Allow header, with HEAD wherever
+// GET is and OPTIONS always. RFC 9110 10.2.1
+func allow(routes []*route) string {
+	var methods []string
+	add := func(m string) {
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	for _, rt := range routes {
+		add(rt.method)
+		if rt.method == "GET" {
+			add("HEAD")
+		}
+	}
+	add("OPTIONS")
+	slices.Sort(methods)
+	return strings.Join(methods, ", ")
+}
+
+// escapedPath returns the path of req as sent, so an escaped slash stays
+// inside its segment.
+func escapedPath(req *request.Request) string {
+	if req.URL == nil {
+		return ""
+	}
+	return req.URL.EscapedPath()
+}
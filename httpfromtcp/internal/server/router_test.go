@@ -0,0 +1,175 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+// reply answers with name and the path values asked for, so tests can tell
+// which route handled a request.
+func reply(name string, params ...string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + req.PathValue(p)
+		}
+		w.WriteBody([]byte(body))
+	}
+}
+
+func send(method, target string) string {
+	return method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+}
+
+func body(raw string) string {
+	_, b, _ := strings.Cut(raw, "\r\n\r\n")
+	return b
+}
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	r.Get("/", reply("home"))
+	r.Get("/users", reply("list"))
+	r.Post("/users", reply("create"))
+	r.Get("/users/{id}", reply("user", "id"))
+	r.Get("/users/me", reply("me"))
+	r.Delete("/users/{id}", reply("delete", "id"))
+	r.Get("/users/{id}/posts/{post}", reply("post", "id", "post"))
+	r.Get("/files/{path...}", reply("file", "path"))
+	r.Get("/files/special", reply("special"))
+
+	// Test: Literal routes
+	assert.Equal(t, "home", body(serveRequest(t, r.Serve, get("/"))))
+	assert.Equal(t, "list", body(serveRequest(t, r.Serve, get("/users"))))
+	assert.Equal(t, "create", body(serveRequest(t, r.Serve, send("POST", "/users"))))
+
+	// Test: Wildcards and their values
+	assert.Equal(t, "user id=42", body(serveRequest(t, r.Serve, get("/users/42"))))
+	assert.Equal(t, "delete id=42", body(serveRequest(t, r.Serve, send("DELETE", "/users/42"))))
+	assert.Equal(t, "post id=7 post=hello", body(serveRequest(t, r.Serve, get("/users/7/posts/hello"))))
+	assert.Equal(t, "file path=a/b/c.txt", body(serveRequest(t, r.Serve, get("/files/a/b/c.txt"))))
+	assert.Equal(t, "file path=", body(serveRequest(t, r.Serve, get("/files/"))))
+
+	// Test: Values are decoded, an escaped slash stays in its segment
+	assert.Equal(t, "user id=a b", body(serveRequest(t, r.Serve, get("/users/a%20b"))))
+	assert.Equal(t, "user id=a/b", body(serveRequest(t, r.Serve, get("/users/a%2Fb"))))
+
+	// Test: Most specific route wins
+	assert.Equal(t, "me", body(serveRequest(t, r.Serve, get("/users/me"))))
+	assert.Equal(t, "special", body(serveRequest(t, r.Serve, get("/files/special"))))
+	assert.Equal(t, "file path=special/x", body(serveRequest(t, r.Serve, get("/files/special/x"))))
+
+	// Test: The method picks between routes before specificity does
+	assert.Equal(t, "delete id=me", body(serveRequest(t, r.Serve, send("DELETE", "/users/me"))))
+
+	// Test: No route for the path
+	got := serveRequest(t, r.Serve, get("/nope"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+	got = serveRequest(t, r.Serve, get("/users/"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"), "empty segment does not match {id}")
+	got = serveRequest(t, r.Serve, get("/users/1/posts"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+	got = serveRequest(t, r.Serve, get("/files"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Route for the path, not the method
+	got = serveRequest(t, r.Serve, send("PUT", "/users/42"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, got, "Allow: DELETE, GET, HEAD, OPTIONS\r\n")
+	got = serveRequest(t, r.Serve, send("DELETE", "/users"))
+	assert.Contains(t, got, "Allow: GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: HEAD is served by the GET route, without the body
+	got = serveRequest(t, r.Serve, send("HEAD", "/users/42"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, got, "Content-Length: 10\r\n")
+	assert.Equal(t, "", body(got))
+
+	// Test: OPTIONS lists the methods for the path
+	got = serveRequest(t, r.Serve, send("OPTIONS", "/users"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, got, "Allow: GET, HEAD, OPTIONS, POST\r\n")
+	assert.NotContains(t, got, "Content-Length")
+
+	// Test: OPTIONS * lists every method
+	got = serveRequest(t, r.Serve, send("OPTIONS", "*"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, got, "Allow: DELETE, GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: Explicit HEAD and OPTIONS routes take over
+	r.Handle("HEAD", "/users", reply("head"))
+	r.Handle("OPTIONS", "/users", reply("options"))
+	got = serveRequest(t, r.Serve, send("HEAD", "/users"))
+	assert.Contains(t, got, "Content-Length: 4\r\n")
+	assert.Equal(t, "options", body(serveRequest(t, r.Serve, send("OPTIONS", "/users"))))
+
+	// Test: Error bodies are JSON for clients that ask for it
+	got = serveRequest(t, r.Serve, "GET /nope HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n")
+	assert.Contains(t, got, "Content-Type: application/json\r\n")
+	assert.Equal(t, "{\"status\":404,\"error\":\"not found\"}\n", body(got))
+	assert.Equal(t, body(got), string(ErrorJSON(response.StatusNotFound, "not found")))
+
+	// Test: Custom NotFound
+	r.NotFound = reply("custom")
+	assert.Equal(t, "custom", body(serveRequest(t, r.Serve, get("/nope"))))
+}
+
+func TestRouterGroups(t *testing.T) {
+	r := NewRouter()
+	api := r.Group("/api")
+	api.Get("/status", reply("status"))
+	v1 := api.Group("/v1")
+	v1.Get("/items/{id}", reply("item", "id"))
+	v1.Put("/items/{id}", reply("put", "id"))
+
+	// Test: Prefixes add up
+	assert.Equal(t, "status", body(serveRequest(t, r.Serve, get("/api/status"))))
+	assert.Equal(t, "item id=3", body(serveRequest(t, r.Serve, get("/api/v1/items/3"))))
+	assert.Equal(t, "put id=3", body(serveRequest(t, r.Serve, send("PUT", "/api/v1/items/3"))))
+
+	// Test: Nothing is registered at the prefix itself
+	got := serveRequest(t, r.Serve, get("/api"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+	got = serveRequest(t, r.Serve, get("/items/3"))
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Empty pattern registers the prefix itself, next to a rest wildcard
+	proxy := r.Group("/proxy")
+	proxy.Get("", reply("root"))
+	proxy.Get("/{path...}", reply("below", "path"))
+	assert.Equal(t, "root", body(serveRequest(t, r.Serve, get("/proxy"))))
+	assert.Equal(t, "below path=", body(serveRequest(t, r.Serve, get("/proxy/"))))
+	assert.Equal(t, "below path=a/b", body(serveRequest(t, r.Serve, get("/proxy/a/b"))))
+}
+
+func TestRouterPatterns(t *testing.T) {
+	handle := func(method, pattern string) func() {
+		return func() {
+			r := NewRouter()
+			r.Get("/users/{id}", reply("user"))
+			r.Handle(method, pattern, reply("x"))
+		}
+	}
+
+	// Test: Valid patterns
+	assert.NotPanics(t, handle("GET", "/users/me"))
+	assert.NotPanics(t, handle("POST", "/users/{name}"))
+	assert.NotPanics(t, handle("GET", "/users/{id}/{rest...}"))
+
+	// Test: Same method and shape conflict, whatever the wildcard names
+	assert.Panics(t, handle("GET", "/users/{name}"))
+
+	// Test: Malformed patterns
+	assert.Panics(t, handle("GET", "users"))
+	assert.Panics(t, handle("GET", "/a/{rest...}/b"))
+	assert.Panics(t, handle("GET", "/a/{x}/{x}"))
+	assert.Panics(t, handle("GET", "/a/b{x}"))
+	assert.Panics(t, handle("GET", "/a/{x"))
+	assert.Panics(t, handle("GET", "/a/{}"))
+	assert.Panics(t, handle("BAD METHOD", "/a"))
+	assert.Panics(t, func() { NewRouter().Group("/api/") })
+}
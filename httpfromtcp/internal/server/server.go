@@ -1,25 +1,91 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/livingpool/httpfromtcp/internal/headers"
 	"github.com/livingpool/httpfromtcp/internal/request"
 	"github.com/livingpool/httpfromtcp/internal/response"
 )
 
+const (
+	lingerTimeout  = 500 * time.Millisecond
+	maxLingerBytes = 256 << 10
+
+	// acceptRetryDelay is how long the accept loop waits after an error,
+	// such as running out of file descriptors, before trying again
+	acceptRetryDelay = 50 * time.Millisecond
+	// shutdownPollInterval is how often Shutdown checks for connections gone idle
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
 type Server struct {
 	Port     int
 	Listener net.Listener
 	IsAlive  *atomic.Bool
 	Handler  Handler
+
+	// MaxBodyBytes caps the size of request bodies. Zero means no limit.
+	MaxBodyBytes int64
+	// Limits caps the request-line and header section of requests.
+	Limits request.Limits
+	// ObsFold is how folded header lines are handled. They are rejected with 400 by default.
+	ObsFold headers.ObsFold
+
+	mu    sync.Mutex
+	conns map[net.Conn]connState
 }
 
+// connState tells Shutdown whether a connection can be closed right away.
+type connState int
+
+const (
+	// stateIdle is a connection waiting for its next request
+	stateIdle connState = iota
+	// stateActive is a connection with a request being read or served
+	stateActive
+)
+
 type Handler func(w *response.Writer, req *request.Request)
 
-func Serve(port int, handler Handler) (*Server, error) {
+// Option configures a Server before it starts accepting connections.
+type Option func(*Server)
+
+// WithMaxBodyBytes rejects request bodies larger than n bytes with 413 Content Too Large.
+func WithMaxBodyBytes(n int64) Option {
+	return func(s *Server) {
+		s.MaxBodyBytes = n
+	}
+}
+
+// WithLimits sets the request-line and header limits. Requests over
+// them are answered with 414 URI Too Long or 431 Request Header Fields Too Large.
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.Limits = limits
+	}
+}
+
+// WithObsFold sets how folded header lines in requests are handled.
+func WithObsFold(mode headers.ObsFold) Option {
+	return func(s *Server) {
+		s.ObsFold = mode
+	}
+}
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
@@ -33,26 +99,98 @@ func Serve(port int, handler Handler) (*Server, error) {
 		Listener: listener,
 		IsAlive:  state,
 		Handler:  handler,
+		conns:    make(map[net.Conn]connState),
+	}
+	for _, opt := range opts {
+		opt(server)
 	}
 
 	go server.listen()
 	return server, nil
 }
 
+// Close stops the server at once: it stops accepting connections and closes
+// all of them, cutting off the responses in progress. Use Shutdown to let
+// them finish.
 func (s *Server) Close() error {
 	s.IsAlive.Store(false)
 	err := s.Listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
 	return err
 }
 
-func (s *Server) listen() {
+// Shutdown stops the server gracefully. It stops accepting connections,
+// closes the idle ones, and waits for the others to finish the response in
+// progress, which tells the client the connection is closing. If ctx is done
+// first, the remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.IsAlive.Store(false)
+	err := s.Listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
 	for {
-		if s.IsAlive.Load() == false {
-			return
+		if s.closeIdleConns() {
+			return err
 		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes the connections waiting for a request and reports
+// whether there are none left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == stateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// setConnState records the state of conn. It reports false when conn is
+// to be closed instead, because the server is shutting down and conn would
+// otherwise wait for another request.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == stateIdle && !s.IsAlive.Load() {
+		return false
+	}
+	s.conns[conn] = state
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) listen() {
+	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
-			log.Fatalf("error accepting connection: %v", err)
+			if !s.IsAlive.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("error accepting connection: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
 		}
 
 		fmt.Println("connection accepted:", conn.RemoteAddr())
@@ -61,15 +199,360 @@ func (s *Server) listen() {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Fatalf("error reading request: %v", err)
+	defer func() {
+		s.untrackConn(conn)
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("error closing connection: %v", err)
+		}
+	}()
+
+	parser := request.NewParser(conn)
+	parser.Limits = s.Limits
+	parser.ObsFold = s.ObsFold
+	// a request that has begun to arrive is served, even during Shutdown
+	parser.OnRequestStart = func() { s.setConnState(conn, stateActive) }
+	for {
+		if !s.setConnState(conn, stateIdle) {
+			return
+		}
+		req, err := parser.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) { // the client is done with this connection
+				return
+			}
+			if !s.IsAlive.Load() && errors.Is(err, net.ErrClosed) { // closed by Shutdown or Close
+				return
+			}
+			if errors.Is(err, request.ErrUnreadBody) { // not worth reading to get to the next request
+				lingerClose(conn)
+				return
+			}
+			s.rejectRequest(conn, err)
+			return
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+
+		if !s.serve(conn, req) {
+			return
+		}
 	}
+}
+
+// serve runs the handler for a single request and reports
+// whether the connection can be kept open for the next one.
+func (s *Server) serve(conn net.Conn, req *request.Request) bool {
+	defer req.Body.Close()
 
 	writer := response.NewResponseWriter(conn)
+	if !req.ProtoAtLeast(1, 1) {
+		writer.SetVersion("1.0")
+	}
+	if !req.KeepAlive() {
+		writer.CloseAfterResponse()
+	}
+	writer.OnHeader(func(response.StatusCode, *headers.Headers) {
+		// tell the client not to send more, the server is shutting down
+		if !s.IsAlive.Load() {
+			writer.CloseAfterResponse()
+		}
+	})
+	if req.RequestLine.Method == "HEAD" {
+		writer.OmitBody()
+	}
+
+	// HTTP/1.0 predates virtual hosts, HTTP/1.1 requires the Host header.
+	// Either way there must not be more than one, and it must be valid. RFC 9112 3.2
+	var hostErr string
+	switch hosts := req.Headers.Values("Host"); {
+	case len(hosts) == 0 && req.ProtoAtLeast(1, 1):
+		hostErr = "missing Host header"
+	case len(hosts) > 1:
+		hostErr = "more than one Host header"
+	case len(hosts) == 1 && !validHost(hosts[0]):
+		hostErr = "invalid Host header"
+	}
+	if hostErr != "" {
+		writer.CloseAfterResponse()
+		writeError(writer, req, response.StatusBadRequest, hostErr)
+		return false
+	}
+
+	var body *limitedBody
+	if s.MaxBodyBytes > 0 {
+		if req.ContentLength > s.MaxBodyBytes {
+			writer.CloseAfterResponse()
+			writeError(writer, req, response.StatusContentTooLarge, "request body too large")
+			// the body is still coming, closing on it could reset the connection before the client reads the 413
+			lingerClose(conn)
+			return false
+		}
+		body = &limitedBody{ReadCloser: request.MaxBytesReader(req.Body, s.MaxBodyBytes)}
+		req.Body = body
+	}
+
+	// a client sending "Expect: 100-continue" waits for our go-ahead before sending the body.
+	// HTTP/1.0 clients cannot expect it, so the field is ignored for them. RFC 9110 10.1.1
+	var cont *expectContinueReader
+	if expect, hasExpect := req.Headers.Get("Expect"); hasExpect && req.ProtoAtLeast(1, 1) {
+		if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+			writer.CloseAfterResponse()
+			writeError(writer, req, response.StatusExpectationFailed, "unsupported expectation: "+expect)
+			return false
+		}
+		if req.ContentLength != 0 {
+			cont = &expectContinueReader{ReadCloser: req.Body, w: writer}
+			req.Body = cont
+		}
+	}
+
 	s.Handler(writer, req)
 
-	if err := conn.Close(); err != nil {
-		log.Fatalf("error closing connection: %v", err)
+	if req.MultipartForm != nil {
+		req.MultipartForm.RemoveAll()
+	}
+
+	if body != nil && body.exceeded && !writer.Written() {
+		// the handler gave up without answering
+		writer.CloseAfterResponse()
+		writeError(writer, req, response.StatusContentTooLarge, "request body too large")
+	}
+
+	if err := writer.Finish(); err != nil {
+		if !s.IsAlive.Load() && errors.Is(err, net.ErrClosed) { // cut off by Shutdown or Close
+			return false
+		}
+		log.Printf("error finishing response to %s: %v", conn.RemoteAddr(), err)
+		return false
+	}
+
+	if body != nil && body.exceeded {
+		// the rest of the body is not worth reading, so the connection goes
+		lingerClose(conn)
+		return false
+	}
+
+	if cont != nil && !cont.sent {
+		// the handler answered without asking for the body, so the client
+		// may or may not send it now. Only closing leaves no doubt.
+		return false
+	}
+
+	return writer.KeepAlive()
+}
+
+// validHost reports whether host is a valid Host field value: empty, or a
+// host with an optional port. RFC 9112 3.2, RFC 3986 3.2.2
+//
+//	Host = uri-host [ ":" port ]
+func validHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	name, port := host, ""
+	if strings.HasPrefix(host, "[") { // IP-literal
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return false
+		}
+		if ip := host[1:end]; !strings.Contains(ip, ":") || net.ParseIP(ip) == nil {
+			return false
+		}
+		rest := host[end+1:]
+		if rest != "" && rest[0] != ':' {
+			return false
+		}
+		return rest == "" || validPort(rest[1:])
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		name, port = host[:i], host[i+1:]
+		if !validPort(port) {
+			return false
+		}
+	}
+	if name == "" {
+		return false
+	}
+	// reg-name or IPv4address: unreserved, pct-encoded and sub-delims
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			strings.IndexByte("-._~!$&'()*+,;=", c) >= 0:
+		case c == '%' && i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]):
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validPort reports whether port is all digits, which includes empty.
+func validPort(port string) bool {
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// rejectRequest answers a request that could not be parsed. The connection
+// is closed afterwards, since there is no telling where the next request starts.
+func (s *Server) rejectRequest(conn net.Conn, err error) {
+	statusCode, ok := statusForError(err)
+	if !ok {
+		log.Printf("error reading request from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	writer := response.NewResponseWriter(conn)
+	writer.CloseAfterResponse()
+	writeError(writer, nil, statusCode, err.Error())
+	lingerClose(conn)
+}
+
+// lingerClose shuts down the writing side of conn and reads a bit of what the
+// client is still sending. Closing a socket with unread data makes the kernel
+// reset the connection, and the client may lose the response we just wrote.
+func lingerClose(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.CloseWrite(); err != nil {
+		return
+	}
+	tcpConn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.Copy(io.Discard, io.LimitReader(tcpConn, maxLingerBytes))
+}
+
+// statusForError maps a parse error to the status code of its response.
+// It returns false for errors that leave nobody to respond to,
+// such as a client that hung up halfway through a request.
+func statusForError(err error) (response.StatusCode, bool) {
+	switch {
+	case errors.Is(err, request.ErrURITooLong):
+		return response.StatusURITooLong, true
+	case errors.Is(err, headers.ErrHeaderTooLarge):
+		return response.StatusRequestHeaderFieldsTooLarge, true
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported, true
+	case errors.Is(err, request.ErrUnsupportedTransferCoding):
+		return response.StatusNotImplemented, true
+	case errors.Is(err, request.ErrMalformedRequestLine),
+		errors.Is(err, request.ErrInvalidTarget),
+		errors.Is(err, request.ErrBadContentLength),
+		errors.Is(err, request.ErrAmbiguousFraming),
+		errors.Is(err, request.ErrLineTooLong),
+		errors.Is(err, request.ErrMalformedChunk),
+		errors.Is(err, headers.ErrInvalidToken),
+		errors.Is(err, headers.ErrInvalidFieldValue),
+		errors.Is(err, headers.ErrObsFold),
+		errors.Is(err, headers.ErrMalformedFieldLine):
+		return response.StatusBadRequest, true
+	default:
+		return 0, false
+	}
+}
+
+// writeError sends a response for errors the server handles itself: JSON for
+// clients that ask for it, HTML for browsers and plain text for everyone else.
+// req is nil when the request could not be parsed, which gets plain text.
+func writeError(w *response.Writer, req *request.Request, statusCode response.StatusCode, msg string) {
+	writeErrorHeaders(w, req, statusCode, msg, nil)
+}
+
+// writeErrorHeaders is writeError for responses that need more headers, such
+// as Allow or Location. h may be nil.
+func writeErrorHeaders(w *response.Writer, req *request.Request, statusCode response.StatusCode, msg string, h *headers.Headers) {
+	contentType := "text/plain"
+	if req != nil {
+		contentType = req.Headers.NegotiateContentType("text/plain", "application/json", "text/html")
+	}
+
+	var body string
+	switch contentType {
+	case "application/json":
+		body = string(ErrorJSON(statusCode, msg))
+	case "text/html":
+		body = fmt.Sprintf(errorHTML, statusCode, response.StatusText(statusCode), html.EscapeString(msg))
+	default: // nothing acceptable, plain text is the least surprising
+		contentType = "text/plain"
+		body = msg + "\n"
+	}
+
+	if h == nil {
+		h = response.GetEmptyHeaders()
+	} else {
+		h = h.Clone()
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Content-Type", contentType)
+	if req != nil {
+		h.Set("Vary", "Accept")
+	}
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// ErrorJSON returns the JSON body of an error response, the one the server
+// sends to clients that accept JSON:
+//
+//	{"status":404,"error":"not found"}
+func ErrorJSON(statusCode response.StatusCode, msg string) []byte {
+	b, _ := json.Marshal(struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{int(statusCode), msg})
+	return append(b, '\n')
+}
+
+const errorHTML = `<html>
+  <head>
+    <title>%[1]d %[2]s</title>
+  </head>
+  <body>
+    <h1>%[2]s</h1>
+    <p>%[3]s</p>
+  </body>
+</html>
+`
+
+// limitedBody records whether the handler ran into the body size limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *request.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// expectContinueReader sends the 100 Continue interim response
+// the first time the handler reads the body.
+type expectContinueReader struct {
+	io.ReadCloser
+	w    *response.Writer
+	sent bool
+}
+
+func (r *expectContinueReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		if err := r.w.WriteContinue(); err != nil {
+			return 0, err
+		}
 	}
+	return r.ReadCloser.Read(p)
 }
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livingpool/httpfromtcp/internal/request"
+	"github.com/livingpool/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dial opens a connection to srv and sends raw on it.
+func dial(t *testing.T, srv *Server, raw string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+// waitForConns waits until srv has n connections in state.
+func waitForConns(t *testing.T, srv *Server, state connState, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		count := 0
+		for _, st := range srv.conns {
+			if st == state {
+				count++
+			}
+		}
+		return count == n
+	}, 5*time.Second, time.Millisecond)
+}
+
+// readResponse reads a response with a Content-Length body from r.
+func readResponse(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	resp, err := response.NewParser(r).Next("GET")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	connection, _ := resp.Headers.Get("Connection")
+	return fmt.Sprintf("%d %s %s", resp.StatusLine.StatusCode, connection, body)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("done"))
+	}
+
+	// Test: Idle connections are closed, busy ones finish their response
+	srv, err := Serve(0, handler)
+	require.NoError(t, err)
+	idle, idleReader := dial(t, srv, get("/"))
+	assert.Equal(t, "200  done", readResponse(t, idleReader))
+	_, busyReader := dial(t, srv, get("/slow"))
+	<-started
+	partial, partialReader := dial(t, srv, "GET /partial HTTP/1.1\r\nHost: local")
+	waitForConns(t, srv, stateActive, 2)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = idleReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF, "idle connection closed")
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the response was done: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: No new connections
+	_, err = net.DialTimeout("tcp", srv.Listener.Addr().String(), time.Second)
+	assert.Error(t, err)
+
+	// Test: Request partly sent is read and answered, with Connection: close
+	_, err = io.WriteString(partial, "host\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "200 close done", readResponse(t, partialReader))
+	_, err = partialReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the response was done: %v", err)
+	default:
+	}
+
+	// Test: Response in progress goes out, with Connection: close
+	close(release)
+	assert.Equal(t, "200 close done", readResponse(t, busyReader))
+	_, err = busyReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	select {
+	case err := <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+	})
+	require.NoError(t, err)
+	conn, r := dial(t, srv, get("/"))
+	<-started
+
+	// Test: Connections still busy when the context ends are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = r.ReadByte()
+	var netErr net.Error
+	assert.True(t, errors.Is(err, io.EOF) || errors.As(err, &netErr) && !netErr.Timeout(), "connection closed: %v", err)
+}
+
+func TestClose(t *testing.T) {
+	// Test: Closing keeps the process alive and drops every connection
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("ok"))
+	})
+	require.NoError(t, err)
+	conn, r := dial(t, srv, get("/"))
+	assert.Equal(t, "200  ok", readResponse(t, r))
+	require.NoError(t, srv.Close())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = net.DialTimeout("tcp", srv.Listener.Addr().String(), time.Second)
+	assert.Error(t, err)
+
+	// Test: Shutdown after Close has nothing to wait for
+	assert.ErrorIs(t, srv.Shutdown(context.Background()), net.ErrClosed)
+}
+
+func TestExpectContinue(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/reject" {
+			w.WriteStatusLine(response.StatusForbidden)
+			w.WriteHeaders(response.GetEmptyHeaders())
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		w.Write(body)
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	post := func(target, version, expect, body string) string {
+		return "POST " + target + " HTTP/" + version + "\r\nHost: localhost\r\nExpect: " + expect +
+			"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	}
+
+	// Test: 100 Continue once the handler reads the body
+	conn, r := dial(t, srv, post("/", "1.1", "100-continue", "hello"))
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "200  hello", readResponse(t, r))
+
+	// Test: Handler answering without reading gets no 100, and the connection closes
+	conn, r = dial(t, srv, post("/reject", "1.1", "100-continue", "hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 403 Forbidden\r\n"))
+	assert.NotContains(t, string(raw), "100 Continue")
+
+	// Test: Unknown expectation gets 417, and the connection closes
+	conn, r = dial(t, srv, post("/", "1.1", "something-else", "hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 417 Expectation Failed\r\n"))
+	assert.Contains(t, string(raw), "Connection: close\r\n")
+
+	// Test: HTTP/1.0 ignores Expect, known or not
+	for _, expect := range []string{"100-continue", "something-else"} {
+		_, r = dial(t, srv, post("/", "1.0", expect, "hello")+"hello")
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.0 200 OK\r\n", line, expect)
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("ok"))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		version string
+		head    string
+		status  string
+	}{
+		{"single Host", "1.1", "Host: localhost:42069\r\n", "200"},
+		{"name only", "1.1", "Host: example.com\r\n", "200"},
+		{"IPv4 with port", "1.1", "Host: 127.0.0.1:8080\r\n", "200"},
+		{"IPv6 with port", "1.1", "Host: [::1]:8080\r\n", "200"},
+		{"empty Host", "1.1", "Host: \r\n", "200"},
+		{"missing Host", "1.1", "", "400"},
+		{"missing Host on HTTP/1.0", "1.0", "", "200"},
+		{"two Hosts", "1.1", "Host: x\r\nHost: y\r\n", "400"},
+		{"two identical Hosts", "1.1", "Host: x\r\nHost: x\r\n", "400"},
+		{"two Hosts on HTTP/1.0", "1.0", "Host: x\r\nHost: y\r\n", "400"},
+		{"space in Host", "1.1", "Host: exa mple.com\r\n", "400"},
+		{"list in Host", "1.1", "Host: x, y\r\n", "400"},
+		{"path in Host", "1.1", "Host: example.com/path\r\n", "400"},
+		{"userinfo in Host", "1.1", "Host: user@example.com\r\n", "400"},
+		{"invalid port", "1.1", "Host: example.com:http\r\n", "400"},
+		{"port only", "1.1", "Host: :80\r\n", "400"},
+		{"unclosed IP-literal", "1.1", "Host: [::1\r\n", "400"},
+		{"IPv4 in IP-literal", "1.1", "Host: [127.0.0.1]\r\n", "400"},
+		{"junk after IP-literal", "1.1", "Host: [::1]x\r\n", "400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, r := dial(t, srv, "GET / HTTP/"+tt.version+"\r\n"+tt.head+"\r\n")
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(line, "HTTP/"+tt.version+" "+tt.status+" "), line)
+		})
+	}
+}
+
+func TestRejectRequest(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("ok"))
+	}, WithLimits(request.Limits{MaxHeaderBytes: 256}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		raw    string
+		status string
+	}{
+		{"malformed request-line", "GARBAGE\r\n\r\n", "400 Bad Request"},
+		{"invalid request-target", "GET example.com HTTP/1.1\r\nHost: x\r\n\r\n", "400 Bad Request"},
+		{"invalid field name", "GET / HTTP/1.1\r\nHost: x\r\nBad Name: y\r\n\r\n", "400 Bad Request"},
+		{"invalid Content-Length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: abc\r\n\r\n", "400 Bad Request"},
+		{"ambiguous framing", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n", "400 Bad Request"},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: x\r\nX-A: b\r\n c\r\n\r\n", "400 Bad Request"},
+		{"request-target too long", "GET /" + strings.Repeat("a", request.DefaultMaxRequestLineBytes) + " HTTP/1.1\r\nHost: x\r\n\r\n", "414 URI Too Long"},
+		{"header section too large", "GET / HTTP/1.1\r\nHost: x\r\nX-A: " + strings.Repeat("a", 300) + "\r\n\r\n", "431 Request Header Fields Too Large"},
+		{"unsupported transfer coding", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", "501 Not Implemented"},
+		{"unsupported version", "GET / HTTP/2.0\r\nHost: x\r\n\r\n", "505 HTTP Version Not Supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Test: Error status, then the connection is closed
+			conn, r := dial(t, srv, tt.raw)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			raw, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 "+tt.status+"\r\n"), "%q", raw)
+			assert.Contains(t, string(raw), "Connection: close\r\n")
+
+			// Test: The server keeps accepting
+			_, r = dial(t, srv, get("/"))
+			assert.Equal(t, "200  ok", readResponse(t, r))
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return // the server answers 413
+		}
+		w.Write(body)
+	}, WithMaxBodyBytes(10))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Body within the limit
+	_, r := dial(t, srv, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n0123456789")
+	assert.Equal(t, "200  0123456789", readResponse(t, r))
+
+	// Test: Content-Length over the limit is refused before the handler runs
+	conn, r := dial(t, srv, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 11\r\n\r\n01234567890")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 413 Content Too Large\r\n"), "%q", raw)
+	assert.Contains(t, string(raw), "Connection: close\r\n")
+
+	// Test: Chunked body over the limit fails the read, and the connection closes
+	conn, r = dial(t, srv, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"8\r\n01234567\r\n8\r\n89abcdef\r\n0\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 413 Content Too Large\r\n"), "%q", raw)
+	assert.Contains(t, string(raw), "Connection: close\r\n")
+}
+
+func TestUnreadBody(t *testing.T) {
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("ok")) // the body is left unread
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Small unread body is discarded, the connection carries on
+	_, r := dial(t, srv, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"+get("/"))
+	parser := response.NewParser(r)
+	for range 2 {
+		resp, err := parser.Next("GET")
+		require.NoError(t, err)
+		assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+		assert.True(t, resp.KeepAlive())
+	}
+
+	// Test: Large unread body closes the connection instead of being read
+	size := request.MaxDrainBytes + 1<<20
+	conn, r := dial(t, srv, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: "+strconv.Itoa(size)+"\r\n\r\n")
+	go func() {
+		io.WriteString(conn, strings.Repeat("a", size)+get("/"))
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.Equal(t, "200  ok", readResponse(t, r))
+	_, err = r.ReadByte()
+	var netErr net.Error
+	assert.True(t, errors.Is(err, io.EOF) || errors.As(err, &netErr) && !netErr.Timeout(), "connection closed: %v", err)
+}